@@ -0,0 +1,541 @@
+// Package broker implements the topic-based publish/subscribe broker used by
+// the server and backup binaries. A Broker can also be embedded in-process.
+package broker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-broker/protocol"
+	"go-broker/wal"
+)
+
+// Role selects how a broker takes part in primary/backup replication
+type Role int
+
+const (
+	// Standalone brokers serve publishers and subscribers without a peer.
+	Standalone Role = iota
+	// Primary brokers replicate every publish to a backup before processing it.
+	Primary
+	// Backup brokers buffer replicated messages and take over when the primary fails.
+	Backup
+	// Cluster brokers replicate through Raft with the other members of
+	// Config.Peers. The elected leader serves publishes; every member
+	// buffers its messages like a backup and any of them can take over.
+	Cluster
+)
+
+// String returns a human readable role name
+func (r Role) String() string {
+	switch r {
+	case Standalone:
+		return "STANDALONE"
+	case Primary:
+		return "PRIMARY"
+	case Backup:
+		return "BACKUP"
+	case Cluster:
+		return "CLUSTER"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Config holds the options for a broker
+type Config struct {
+	// Addr is the TCP address to listen on, e.g. ":8080".
+	Addr string
+	// Role selects standalone, primary, backup or cluster behaviour.
+	Role Role
+	// PeerAddr is the backup's address for a primary and the primary's
+	// address for a backup. It is ignored by standalone brokers.
+	PeerAddr string
+
+	// Peers are the addresses of the other members of a cluster, as given
+	// to them in AdvertiseAddr.
+	Peers []string
+	// AdvertiseAddr is the address the other members and redirected
+	// clients reach a cluster member at. Empty selects Addr, on localhost
+	// if Addr has no host.
+	AdvertiseAddr string
+	// RaftDir keeps the Raft term, vote and log of a cluster member across
+	// restarts. Empty keeps them in memory, so a member must not rejoin
+	// after a restart.
+	RaftDir string
+	// ReplicationMode selects whether a primary waits for the backup to
+	// acknowledge a REPLICATE before it ACKs the publisher.
+	ReplicationMode ReplicationMode
+	// ReplicationTimeout is how long a SemiSync primary waits for the
+	// backup. Zero selects DefaultReplicationTimeout.
+	ReplicationTimeout time.Duration
+	// RetryInterval is how long a QoS 1 delivery may stay unacknowledged
+	// before it is retransmitted. Zero selects DefaultRetryInterval.
+	RetryInterval time.Duration
+
+	// HeartbeatInterval is how often a backup pings its primary, and
+	// HeartbeatTimeout how long it waits for each PONG. Zero selects
+	// DefaultHeartbeatInterval and DefaultHeartbeatTimeout.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	// FailureDetector decides from the heartbeats when a backup takes
+	// over. Nil selects a MissDetector with DefaultMissThreshold.
+	FailureDetector FailureDetector
+	// OnSuspicion, if set, is called on the backup's alive-check goroutine
+	// whenever it starts or stops suspecting the primary.
+	OnSuspicion func(SuspicionEvent)
+
+	// SessionQueueLimit, SessionQueueBytes and SessionQueueAge bound the
+	// messages queued for each offline persistent session. The oldest
+	// messages are dropped first. Zero selects the defaults below.
+	SessionQueueLimit int
+	SessionQueueBytes int
+	SessionQueueAge   time.Duration
+
+	// Processors handle every published message before it is delivered,
+	// in order, each one the messages whose topic matches its filter. Nil
+	// selects PseudoCompute between DefaultComputeMin and DefaultComputeMax
+	// for all topics; an empty slice delivers messages as published.
+	Processors []ProcessorRoute
+	// ComputeWorkers is the number of publishes processed at once. Zero
+	// selects DefaultComputeWorkers.
+	ComputeWorkers int
+	// OrderingKey returns the key of a published message. Messages with
+	// the same key are processed one at a time and delivered in the order
+	// they were published; others may overtake each other. Nil orders the
+	// messages of each topic.
+	OrderingKey func(m Message) string
+
+	// OutboundQueueLimit bounds the packets waiting to be written to each
+	// connected client, and OverflowPolicy decides what happens when a
+	// slow client lets its queue fill up. Zero selects
+	// DefaultOutboundQueueLimit and DropOldest.
+	OutboundQueueLimit int
+	OverflowPolicy     OverflowPolicy
+	// WriteTimeout is how long a write to a client or to the backup may
+	// block before the connection is dropped. Zero selects
+	// DefaultWriteTimeout.
+	WriteTimeout time.Duration
+
+	// WALDir enables the write-ahead log: every accepted PUBLISH is
+	// appended there before it is acknowledged, and messages that were
+	// logged but never processed are delivered again on startup. Empty
+	// disables the log.
+	WALDir string
+	// WALSync is the fsync policy of the log.
+	WALSync wal.SyncPolicy
+	// WALSyncInterval is the flush period of wal.SyncInterval. Zero selects
+	// wal.DefaultSyncInterval.
+	WALSyncInterval time.Duration
+	// WALSegmentSize is the size at which a new log segment is started.
+	// Zero selects wal.DefaultSegmentSize.
+	WALSegmentSize int64
+	// RecoveryDelay is how long messages recovered from the write-ahead
+	// log wait before they are delivered, so subscribers can reconnect
+	// after a restart. Zero selects DefaultRecoveryDelay.
+	RecoveryDelay time.Duration
+}
+
+// Defaults for zero Config fields
+const (
+	DefaultReplicationTimeout = 200 * time.Millisecond
+	DefaultRetryInterval      = 5 * time.Second
+	DefaultHeartbeatInterval  = time.Second
+	DefaultHeartbeatTimeout   = 500 * time.Millisecond
+	DefaultSessionQueueLimit  = 1000
+	DefaultSessionQueueBytes  = 1 << 20
+	DefaultSessionQueueAge    = time.Hour
+	DefaultOutboundQueueLimit = 1000
+	DefaultWriteTimeout       = 10 * time.Second
+	DefaultComputeWorkers     = 8
+	DefaultRecoveryDelay      = 5 * time.Second
+)
+
+// Broker handles pub/sub with topic-based routing
+type Broker struct {
+	config       Config
+	listener     net.Listener
+	packets      chan Packet
+	closeConns   chan net.Conn
+	conns        map[net.Conn]struct{} // open connections, each with a reader
+	connsMu      sync.Mutex
+	topics       *topicTree                  // topic filter -> subscribers
+	clients      map[net.Conn]*client        // connection -> will and session
+	sessions     map[string]*session         // client ID -> persistent session
+	retained     map[string]*protocol.Packet // topic -> last retained PUBLISH
+	subscriberMu sync.Mutex
+
+	// QoS 2 publishes received but not yet released, by client ID/packet ID
+	pendingReleases   map[string]struct{}
+	pendingReleasesMu sync.Mutex
+
+	// Write-ahead log of accepted publishes, nil when disabled
+	wal       *wal.Log
+	recovered []wal.Record // unprocessed messages found on startup
+
+	// Primary: connection used to replicate to the backup, whether the
+	// backup has applied the snapshot sent on connect, and the publishes
+	// waiting for the backup's ACK by sequence number
+	backupConn    net.Conn
+	backupHealthy bool
+	backupMu      sync.Mutex
+	backupAcks    map[uint64]chan bool
+	backupAckMu   sync.Mutex
+
+	// Primary: messages replicated to the backup and not processed yet
+	unprocessed   pendingLog
+	unprocessedMu sync.Mutex
+
+	// Cluster: Raft membership, nil for other roles
+	cluster *cluster
+
+	// Leadership epoch, and whether a primary stepped down because it saw
+	// a newer one
+	epoch  atomic.Uint64
+	fenced atomic.Bool
+
+	// Failback requests, run by the application logic goroutine
+	failbacks chan chan error
+	// Whether connectBackup is running
+	connecting atomic.Bool
+
+	// Sequence number of the last PUBLISH when there is no write-ahead
+	// log to assign them
+	lastSeq atomic.Uint64
+
+	// Backup: messages replicated by the primary and not yet cleared
+	replicatedMsgs   pendingLog
+	replicatedMsgsMu sync.Mutex
+	primaryAlive     bool
+	primaryAliveMu   sync.Mutex
+
+	// Compute workers: the queue of each, the processed publishes waiting
+	// for delivery and the number of publishes handed over and not yet
+	// delivered
+	computeQueues []chan Packet
+	computed      chan computed
+	computing     atomic.Int64
+
+	// Packets discarded by the overflow policy of all clients
+	droppedMessages atomic.Uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a broker listening on config.Addr
+func New(config Config) (*Broker, error) {
+	switch config.Role {
+	case Standalone:
+	case Cluster:
+		if len(config.Peers) == 0 {
+			return nil, fmt.Errorf("%s broker requires the addresses of its peers", config.Role)
+		}
+		if config.WALDir != "" {
+			return nil, fmt.Errorf("%s broker keeps its messages in the Raft log, not in a write-ahead log", config.Role)
+		}
+	default:
+		if config.PeerAddr == "" {
+			return nil, fmt.Errorf("%s broker requires a peer address", config.Role)
+		}
+	}
+
+	if config.ReplicationTimeout == 0 {
+		config.ReplicationTimeout = DefaultReplicationTimeout
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = DefaultRetryInterval
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.HeartbeatTimeout == 0 {
+		config.HeartbeatTimeout = DefaultHeartbeatTimeout
+	}
+	if config.FailureDetector == nil {
+		config.FailureDetector = NewMissDetector(DefaultMissThreshold)
+	}
+	if config.SessionQueueLimit == 0 {
+		config.SessionQueueLimit = DefaultSessionQueueLimit
+	}
+	if config.SessionQueueBytes == 0 {
+		config.SessionQueueBytes = DefaultSessionQueueBytes
+	}
+	if config.SessionQueueAge == 0 {
+		config.SessionQueueAge = DefaultSessionQueueAge
+	}
+	if config.Processors == nil {
+		config.Processors = []ProcessorRoute{{Filter: "#", Processor: PseudoCompute{Min: DefaultComputeMin, Max: DefaultComputeMax}}}
+	}
+	if err := validateProcessors(config.Processors); err != nil {
+		return nil, err
+	}
+	if config.RecoveryDelay == 0 {
+		config.RecoveryDelay = DefaultRecoveryDelay
+	}
+	if config.ComputeWorkers == 0 {
+		config.ComputeWorkers = DefaultComputeWorkers
+	}
+	if config.ComputeWorkers < 0 {
+		return nil, fmt.Errorf("invalid number of compute workers: %d", config.ComputeWorkers)
+	}
+	if config.OutboundQueueLimit == 0 {
+		config.OutboundQueueLimit = DefaultOutboundQueueLimit
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var log *wal.Log
+	var recovered []wal.Record
+	if config.WALDir != "" {
+		log, recovered, err = wal.Open(wal.Options{
+			Dir:          config.WALDir,
+			SegmentSize:  config.WALSegmentSize,
+			Sync:         config.WALSync,
+			SyncInterval: config.WALSyncInterval,
+		})
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("opening write-ahead log: %w", err)
+		}
+	}
+
+	var members *cluster
+	if config.Role == Cluster {
+		members, err = newCluster(config)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("setting up Raft: %w", err)
+		}
+	}
+
+	b := &Broker{
+		config:          config,
+		listener:        listener,
+		packets:         make(chan Packet, 10),
+		closeConns:      make(chan net.Conn, 10),
+		conns:           make(map[net.Conn]struct{}),
+		topics:          newTopicTree(),
+		clients:         make(map[net.Conn]*client),
+		sessions:        make(map[string]*session),
+		retained:        make(map[string]*protocol.Packet),
+		pendingReleases: make(map[string]struct{}),
+		backupAcks:      make(map[uint64]chan bool),
+		wal:             log,
+		recovered:       recovered,
+		cluster:         members,
+		primaryAlive:    true,
+		failbacks:       make(chan chan error),
+		computed:        make(chan computed, config.ComputeWorkers),
+		done:            make(chan struct{}),
+	}
+	for range config.ComputeWorkers {
+		b.computeQueues = append(b.computeQueues, make(chan Packet, computeQueueLength))
+	}
+	// Snapshots continue from the write-ahead log's numbering
+	if log != nil {
+		b.lastSeq.Store(log.LastSeq())
+	}
+	// Backups learn the epoch from their primary, cluster members from
+	// the Raft term
+	if config.Role != Backup && config.Role != Cluster {
+		b.epoch.Store(1)
+	}
+	return b, nil
+}
+
+// Addr returns the address the broker is listening on
+func (b *Broker) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// Role returns the role the broker was configured with
+func (b *Broker) Role() Role {
+	return b.config.Role
+}
+
+// Start starts the broker goroutines and returns immediately
+func (b *Broker) Start() {
+	fmt.Printf("%s broker started on %s\n", b.config.Role, b.listener.Addr())
+
+	// Before the backup can attach and ask for a snapshot
+	recovered := b.recoverLog()
+
+	switch b.config.Role {
+	case Primary:
+		// Keep trying to reach the backup in the background
+		go b.connectBackup()
+	case Backup:
+		fmt.Println("Primary broker is at", b.config.PeerAddr)
+		go b.aliveCheck()
+	case Cluster:
+		fmt.Printf("Cluster member %s, peers: %v\n", b.cluster.addr, b.config.Peers)
+		b.cluster.node.Start()
+		go b.applyCommitted()
+	}
+
+	// Goroutine 1: Application logic (handle PUBLISH and SUBSCRIBE)
+	go b.applicationLogic()
+
+	// Compute workers run the processors of publishes for the application
+	// logic
+	for _, queue := range b.computeQueues {
+		go b.computeWorker(queue)
+	}
+
+	// Goroutine 2: Proxy - accepts new connections and starts a reader
+	// goroutine for each
+	go b.proxy()
+
+	if len(recovered) > 0 {
+		go b.replayLog(recovered)
+	}
+}
+
+// Close stops the broker and closes its listener
+func (b *Broker) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		err = b.listener.Close()
+		b.closeConnections()
+
+		b.backupMu.Lock()
+		if b.backupConn != nil {
+			b.backupConn.Close()
+			b.backupConn = nil
+		}
+		b.backupMu.Unlock()
+
+		if b.cluster != nil {
+			b.cluster.node.Stop()
+			b.cluster.close()
+		}
+
+		if b.wal != nil {
+			if walErr := b.wal.Close(); err == nil {
+				err = walErr
+			}
+		}
+	})
+	return err
+}
+
+// BackupHealthy reports whether a primary is connected to its backup and
+// the backup has caught up with the snapshot sent on connect
+func (b *Broker) BackupHealthy() bool {
+	b.backupMu.Lock()
+	defer b.backupMu.Unlock()
+	return b.backupConn != nil && b.backupHealthy
+}
+
+// DroppedMessages returns how many packets the overflow policy discarded
+// because a client did not keep up
+func (b *Broker) DroppedMessages() uint64 {
+	return b.droppedMessages.Load()
+}
+
+// closed reports whether Close has been called
+func (b *Broker) closed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// acceptsPublish reports whether PUBLISH packets from clients should be
+// processed. A backup only serves publishers once the primary is down, a
+// primary that saw a newer epoch not at all, and a cluster member only
+// while it leads.
+func (b *Broker) acceptsPublish() bool {
+	if b.fenced.Load() {
+		return false
+	}
+	if b.cluster != nil {
+		return b.cluster.active()
+	}
+	if b.config.Role != Backup {
+		return true
+	}
+	b.primaryAliveMu.Lock()
+	defer b.primaryAliveMu.Unlock()
+	return !b.primaryAlive
+}
+
+// replicating reports whether this broker replicates what it processes:
+// a primary to its backup, a cluster leader to the other members
+func (b *Broker) replicating() bool {
+	if b.cluster != nil {
+		return b.cluster.active()
+	}
+	return b.config.Role == Primary
+}
+
+// applicationLogic handles the broker logic (routing messages to subscribers)
+func (b *Broker) applicationLogic() {
+	retryTicker := time.NewTicker(b.config.RetryInterval)
+	defer retryTicker.Stop()
+
+	for {
+		select {
+		case packet := <-b.packets:
+			switch packet.Type {
+			case protocol.SUBSCRIBE:
+				b.handleSubscribe(packet)
+			case protocol.UNSUBSCRIBE:
+				b.handleUnsubscribe(packet)
+			case protocol.CONNECT:
+				b.handleConnect(packet)
+			case protocol.DISCONNECT:
+				b.handleGoodbye(packet)
+			case protocol.PUBACK:
+				b.handlePuback(packet)
+			case protocol.PUBREL:
+				b.handlePubrel(packet)
+			case protocol.PUBLISH:
+				if b.acceptsPublish() {
+					b.handlePublish(packet)
+				} else {
+					// The broker in charge will process it
+					b.redirectToLeader(packet)
+					packet.conn.Close()
+				}
+			case protocol.REPLICATE:
+				b.handleReplicate(packet)
+			case protocol.CLEAR:
+				b.handleClear(packet)
+			case protocol.SESSION:
+				b.handleSession(packet)
+			case protocol.SNAPSHOT:
+				b.handleSnapshot(packet)
+			case protocol.RETAINED:
+				b.handleRetained(packet)
+			case protocol.PUBREC:
+				b.handlePubrec(packet)
+			case protocol.FAILBACK:
+				b.handleFailback(packet)
+			}
+		case result := <-b.computed:
+			b.deliverPublish(result)
+		case conn := <-b.closeConns:
+			b.publishWill(conn)
+			b.handleDisconnect(conn)
+		case result := <-b.failbacks:
+			result <- b.failback()
+		case <-retryTicker.C:
+			b.retransmit()
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// inflightMessage is a QoS 1 delivery waiting for its PUBACK
+type inflightMessage struct {
+	packet *protocol.Packet
+	sentAt time.Time
+}
+
+// client is the broker-side state of one connection
+type client struct {
+	conn    net.Conn
+	legacy  bool             // speaks the legacy text format
+	will    *protocol.Packet // Last Will and Testament, published on unclean drops
+	session *session         // subscriptions and delivery state
+	out     *outbound        // packets waiting for the writer goroutine
+}
+
+// send queues a packet for the client's writer, which writes it in the
+// format the client understands. A full queue is handled by the overflow
+// policy.
+func (c *client) send(p *protocol.Packet) error {
+	return c.out.push(p)
+}
+
+// clientFor returns the state of conn, creating it with a private,
+// non-persistent session and starting its writer on first use. The caller
+// must hold subscriberMu.
+func (b *Broker) clientFor(conn net.Conn, legacy bool) *client {
+	c, ok := b.clients[conn]
+	if !ok {
+		c = &client{
+			conn:   conn,
+			legacy: legacy,
+			out:    newOutbound(conn.RemoteAddr().String(), b.config.OutboundQueueLimit, b.config.OverflowPolicy, &b.droppedMessages),
+		}
+		c.session = newSession("")
+		c.session.client = c
+		b.clients[conn] = c
+		go b.writeLoop(c)
+	}
+	return c
+}
+
+// deliver sends message to session s at the given QoS, or queues it while
+// a persistent session is offline. Deliveries carry the broker's epoch.
+// QoS 1 deliveries get a per-session packet ID and stay in flight until
+// the client sends PUBACK.
+// The caller must hold subscriberMu.
+func (b *Broker) deliver(s *session, message *protocol.Packet, qos byte) error {
+	if s.client == nil {
+		s.enqueue(message, qos, b.config)
+		return nil
+	}
+
+	out := *message
+	out.SetQoS(qos)
+	out.Epoch = b.epoch.Load()
+	if qos >= protocol.AtLeastOnce {
+		s.lastID++
+		out.ID = s.lastID
+		s.inflight[out.ID] = &inflightMessage{packet: &out, sentAt: time.Now()}
+	}
+	return s.client.send(&out)
+}
+
+// handlePuback completes a QoS 1 delivery
+func (b *Broker) handlePuback(packet Packet) {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+
+	c, ok := b.clients[packet.conn]
+	if !ok {
+		return
+	}
+	if message, ok := c.session.inflight[packet.ID]; ok {
+		delete(c.session.inflight, packet.ID)
+		fmt.Printf("Message %d on topic '%s' delivered to %s\n", packet.ID, message.packet.Topic, packet.conn.RemoteAddr())
+	}
+}
+
+// retransmit resends QoS 1 deliveries that were not acknowledged within
+// the retry interval and expires old messages queued for offline sessions
+func (b *Broker) retransmit() {
+	b.subscriberMu.Lock()
+	var failed []net.Conn
+	now := time.Now()
+	for conn, c := range b.clients {
+		for id, message := range c.session.inflight {
+			if now.Sub(message.sentAt) < b.config.RetryInterval {
+				continue
+			}
+			message.packet.Flags |= protocol.FlagDup
+			message.sentAt = now
+			fmt.Printf("Retransmitting message %d on topic '%s' to %s\n", id, message.packet.Topic, conn.RemoteAddr())
+			if err := c.send(message.packet); err != nil {
+				fmt.Println("Error writing to subscriber:", err)
+				failed = append(failed, conn)
+				break
+			}
+		}
+	}
+	for _, s := range b.sessions {
+		if s.client == nil {
+			s.expire(now, b.config.SessionQueueAge)
+		}
+	}
+	b.subscriberMu.Unlock()
+
+	for _, conn := range failed {
+		b.handleDisconnect(conn)
+	}
+}
@@ -0,0 +1,284 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-broker/protocol"
+	"go-broker/raft"
+)
+
+// Raft traffic between cluster members
+const (
+	// raftCallTimeout bounds one Raft request and its reply
+	raftCallTimeout = 500 * time.Millisecond
+	// commitTimeout is how long the leader waits for a majority to store
+	// a publish before the publisher is refused
+	commitTimeout = 2 * time.Second
+)
+
+var errNoCluster = errors.New("RAFT packet for a broker that is not in cluster mode")
+
+// cluster is the Raft membership of a broker in Cluster mode. The members
+// agree on one log of the replication packets a primary would send its
+// backup: the leader proposes REPLICATE, CLEAR, SESSION and PUBREL packets,
+// and every other member applies them like a backup once they are
+// committed. The member whose first entry of a term is applied while it
+// leads that term takes over like a backup whose primary failed.
+type cluster struct {
+	node *raft.Node
+	addr string // the address other members and clients reach us at
+
+	links map[string]*peerLink // member address -> Raft connection
+
+	// The term this member last took over in. Entries of that term are
+	// its own and were applied when they were proposed.
+	activeTerm atomic.Uint64
+	// The term of the last applied entry, only used by applyCommitted
+	appliedTerm uint64
+}
+
+// peerLink is the connection Raft requests to one member are sent on
+type peerLink struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	decoder *protocol.Decoder
+}
+
+// advertiseAddr is the address of a broker as seen by the other members
+func advertiseAddr(config Config) string {
+	if config.AdvertiseAddr != "" {
+		return config.AdvertiseAddr
+	}
+	if strings.HasPrefix(config.Addr, ":") {
+		return "localhost" + config.Addr
+	}
+	return config.Addr
+}
+
+// newCluster sets up the Raft node of a broker in Cluster mode
+func newCluster(config Config) (*cluster, error) {
+	c := &cluster{
+		addr:  advertiseAddr(config),
+		links: make(map[string]*peerLink),
+	}
+	for _, peer := range config.Peers {
+		c.links[peer] = &peerLink{}
+	}
+
+	node, err := raft.New(raft.Config{
+		ID:        c.addr,
+		Peers:     config.Peers,
+		Dir:       config.RaftDir,
+		Transport: c,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.node = node
+	return c, nil
+}
+
+// Call sends a Raft message to a member in a RAFT packet and waits for the
+// reply. It implements raft.Transport.
+func (c *cluster) Call(peer string, m *raft.Message) (*raft.Message, error) {
+	link, ok := c.links[peer]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster member %s", peer)
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	if link.conn == nil {
+		conn, err := net.DialTimeout("tcp", peer, raftCallTimeout)
+		if err != nil {
+			return nil, err
+		}
+		link.conn = conn
+		link.decoder = protocol.NewDecoder(conn)
+	}
+
+	link.conn.SetDeadline(time.Now().Add(raftCallTimeout))
+	err = protocol.Write(link.conn, &protocol.Packet{Type: protocol.RAFT, Payload: data})
+	for err == nil {
+		var response *protocol.Packet
+		response, err = link.decoder.Decode()
+		if err != nil || response.Type != protocol.RAFT {
+			continue
+		}
+		reply := &raft.Message{}
+		if err = reply.UnmarshalBinary(response.Payload); err == nil {
+			return reply, nil
+		}
+	}
+
+	// The connection is out of step with the member: start over
+	link.conn.Close()
+	link.conn = nil
+	return nil, err
+}
+
+// close drops the connections to the other members
+func (c *cluster) close() {
+	for _, link := range c.links {
+		link.mu.Lock()
+		if link.conn != nil {
+			link.conn.Close()
+			link.conn = nil
+		}
+		link.mu.Unlock()
+	}
+}
+
+// active reports whether this member leads the cluster and has taken over
+func (c *cluster) active() bool {
+	term, _, isLeader := c.node.Status()
+	return isLeader && term == c.activeTerm.Load()
+}
+
+// leaderAddr returns the address of the current leader, or "" if it is
+// unknown or this member
+func (c *cluster) leaderAddr() string {
+	_, leader, _ := c.node.Status()
+	if leader == c.addr {
+		return ""
+	}
+	return leader
+}
+
+// propose appends a replication packet to the Raft log without waiting for
+// it to be committed
+func (c *cluster) propose(p *protocol.Packet) (uint64, uint64, error) {
+	data, err := protocol.Encode(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.node.Propose(data)
+}
+
+// replicate appends a REPLICATE to the Raft log and reports whether a
+// majority of the cluster stored it in time
+func (c *cluster) replicate(p *protocol.Packet) bool {
+	index, term, err := c.propose(p)
+	if err == nil {
+		err = c.node.Wait(index, term, commitTimeout)
+	}
+	if err != nil {
+		fmt.Printf("Message #%d not committed by the cluster: %v\n", p.Seq, err)
+		return false
+	}
+	return true
+}
+
+// handleRaft answers a Raft message from another member. It runs on the
+// reader of the member's connection, so heartbeats are not held up by
+// message processing.
+func (b *Broker) handleRaft(packet Packet) error {
+	if b.cluster == nil {
+		return errNoCluster
+	}
+	m := &raft.Message{}
+	if err := m.UnmarshalBinary(packet.Payload); err != nil {
+		return err
+	}
+	response := b.cluster.node.Handle(m)
+	if response == nil {
+		return fmt.Errorf("unexpected Raft message %s", m.Type)
+	}
+	data, err := response.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return reply(packet, &protocol.Packet{Type: protocol.RAFT, Payload: data})
+}
+
+// applyCommitted applies the entries the cluster committed, in log order
+func (b *Broker) applyCommitted() {
+	for {
+		select {
+		case entry := <-b.cluster.node.Applied():
+			b.applyEntry(entry)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// applyEntry applies one committed entry the way a backup applies what its
+// primary sends. The first entry of every term carries no data and
+// announces its leader.
+func (b *Broker) applyEntry(entry raft.Entry) {
+	if len(entry.Data) == 0 {
+		b.newTerm(entry.Term)
+		return
+	}
+	// We applied our own entries when we proposed them
+	if entry.Term == b.cluster.activeTerm.Load() {
+		return
+	}
+
+	p, err := protocol.NewDecoder(bytes.NewReader(entry.Data)).Decode()
+	if err != nil {
+		fmt.Printf("Ignoring undecodable cluster entry #%d: %v\n", entry.Index, err)
+		return
+	}
+	packet := Packet{Packet: p}
+	switch p.Type {
+	case protocol.REPLICATE:
+		b.handleReplicate(packet)
+	case protocol.CLEAR:
+		b.handleClear(packet)
+	case protocol.SESSION:
+		b.handleSession(packet)
+	case protocol.PUBREL:
+		b.handlePubrel(packet)
+	default:
+		fmt.Printf("Ignoring %s in cluster entry #%d\n", p.Type, entry.Index)
+	}
+}
+
+// newTerm handles the start of a term. If we lead it, we take over: the
+// messages older leaders committed but never processed are delivered, and
+// from now on we serve publishes.
+func (b *Broker) newTerm(term uint64) {
+	b.observeEpoch(term)
+	current, leader, isLeader := b.cluster.node.Status()
+	wasActive := b.cluster.appliedTerm != 0 && b.cluster.appliedTerm == b.cluster.activeTerm.Load()
+	b.cluster.appliedTerm = term
+
+	if isLeader && current == term {
+		b.cluster.activeTerm.Store(term)
+		fmt.Printf("✓ Leading the cluster in term %d\n", term)
+		b.processReplicatedMessages()
+		return
+	}
+	if current == term && leader != "" {
+		fmt.Printf("%s leads the cluster in term %d\n", leader, term)
+	}
+	if wasActive {
+		fmt.Println("⚠️  No longer leading the cluster: back to standby")
+	}
+}
+
+// redirectToLeader tells a client that reached a cluster member which is
+// not leading where the leader is
+func (b *Broker) redirectToLeader(packet Packet) {
+	if b.cluster == nil || packet.Legacy {
+		return
+	}
+	if leader := b.cluster.leaderAddr(); leader != "" {
+		fmt.Printf("Redirecting %s to the cluster leader at %s\n", packet.conn.RemoteAddr(), leader)
+		reply(packet, b.stamp(&protocol.Packet{Type: protocol.DISCONNECT, Topic: leader}))
+	}
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"hash/fnv"
+	"maps"
+)
+
+// computeQueueLength is the number of publishes a compute worker buffers
+// before handing it more has to wait
+const computeQueueLength = 10
+
+// computed is a publish and the messages its processors returned
+type computed struct {
+	packet   Packet
+	messages []Message
+}
+
+// published returns the message of a PUBLISH as processors see it. The
+// headers are copied, so processors may change them.
+func published(packet Packet) Message {
+	return Message{Topic: packet.Topic, Payload: packet.Payload, Headers: maps.Clone(packet.Headers), Retain: packet.Retain()}
+}
+
+// computeWorker runs the processors on the publishes of its queue, one at a
+// time, and hands the results to the application logic in the same order
+func (b *Broker) computeWorker(queue <-chan Packet) {
+	for {
+		select {
+		case packet := <-queue:
+			result := computed{packet: packet, messages: b.process(published(packet))}
+			select {
+			case b.computed <- result:
+			case <-b.done:
+				return
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// computeQueue returns the queue of the worker for the ordering key of a
+// publish. Publishes with the same key always go to the same worker, so
+// they are delivered in the order they were handed over.
+func (b *Broker) computeQueue(packet Packet) chan<- Packet {
+	key := packet.Topic
+	if b.config.OrderingKey != nil {
+		key = b.config.OrderingKey(published(packet))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return b.computeQueues[h.Sum32()%uint32(len(b.computeQueues))]
+}
+
+// handlePublish hands a publish to its compute worker. It is called by the
+// application logic goroutine, which delivers finished publishes while it
+// waits for room in the queue.
+func (b *Broker) handlePublish(packet Packet) {
+	queue := b.computeQueue(packet)
+	b.computing.Add(1)
+	for {
+		select {
+		case queue <- packet:
+			return
+		case result := <-b.computed:
+			b.deliverPublish(result)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// replayPublish hands a publish to its compute worker from a goroutine
+// other than the application logic
+func (b *Broker) replayPublish(packet Packet) {
+	b.computing.Add(1)
+	select {
+	case b.computeQueue(packet) <- packet:
+	case <-b.done:
+	}
+}
+
+// drainCompute waits until every publish handed to the compute workers has
+// been delivered. It is called by the application logic goroutine.
+func (b *Broker) drainCompute() {
+	for b.computing.Load() > 0 {
+		select {
+		case result := <-b.computed:
+			b.deliverPublish(result)
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// Default thresholds of the failure detectors
+const (
+	DefaultMissThreshold = 3
+	DefaultPhiThreshold  = 8.0
+)
+
+// FailureDetector decides from the outcome of heartbeats whether the
+// primary has failed. A backup takes over once the detector suspects it.
+type FailureDetector interface {
+	// Name identifies the strategy in suspicion events.
+	Name() string
+	// Heartbeat records a heartbeat answered at t.
+	Heartbeat(t time.Time)
+	// Miss records a heartbeat that was not answered in time at t.
+	Miss(t time.Time)
+	// Suspicion returns how strongly the primary is suspected at t and
+	// the level at which it counts as failed.
+	Suspicion(t time.Time) (level, threshold float64)
+}
+
+// MissDetector suspects the primary after a number of consecutive missed
+// heartbeats. Its suspicion level is the count of misses.
+type MissDetector struct {
+	threshold int
+	misses    int
+}
+
+// NewMissDetector returns a detector that suspects the primary after
+// threshold missed heartbeats in a row
+func NewMissDetector(threshold int) *MissDetector {
+	return &MissDetector{threshold: max(threshold, 1)}
+}
+
+// Name returns "misses"
+func (d *MissDetector) Name() string {
+	return "misses"
+}
+
+// Heartbeat resets the count of misses
+func (d *MissDetector) Heartbeat(time.Time) {
+	d.misses = 0
+}
+
+// Miss counts a missed heartbeat
+func (d *MissDetector) Miss(time.Time) {
+	d.misses++
+}
+
+// Suspicion returns the count of consecutive misses
+func (d *MissDetector) Suspicion(time.Time) (float64, float64) {
+	return float64(d.misses), float64(d.threshold)
+}
+
+// phiWindowSize is how many heartbeat intervals the phi accrual detector
+// bases its estimate on
+const phiWindowSize = 100
+
+// PhiAccrualDetector implements the phi accrual failure detector: it learns
+// the distribution of the intervals between heartbeats and suspects the
+// primary once a heartbeat is so overdue that phi, the negative decimal
+// logarithm of the chance it is still coming, exceeds the threshold. A phi
+// of 8 means the chance of a wrong suspicion is about 1 in 10^8.
+type PhiAccrualDetector struct {
+	threshold float64
+	minStdDev time.Duration
+	intervals []time.Duration
+	last      time.Time
+}
+
+// NewPhiAccrualDetector returns a phi accrual detector with the given
+// threshold. minStdDev keeps very regular heartbeats from making a single
+// late one suspicious.
+func NewPhiAccrualDetector(threshold float64, minStdDev time.Duration) *PhiAccrualDetector {
+	return &PhiAccrualDetector{threshold: threshold, minStdDev: minStdDev}
+}
+
+// Name returns "phi-accrual"
+func (d *PhiAccrualDetector) Name() string {
+	return "phi-accrual"
+}
+
+// Heartbeat records the interval since the previous heartbeat
+func (d *PhiAccrualDetector) Heartbeat(t time.Time) {
+	if !d.last.IsZero() {
+		d.intervals = append(d.intervals, t.Sub(d.last))
+		if len(d.intervals) > phiWindowSize {
+			d.intervals = d.intervals[1:]
+		}
+	}
+	d.last = t
+}
+
+// Miss does nothing: phi grows with the time since the last heartbeat
+func (d *PhiAccrualDetector) Miss(time.Time) {}
+
+// Suspicion returns phi for the time since the last heartbeat
+func (d *PhiAccrualDetector) Suspicion(t time.Time) (float64, float64) {
+	if d.last.IsZero() || len(d.intervals) == 0 {
+		// Nothing learned yet
+		return 0, d.threshold
+	}
+
+	var mean float64
+	for _, interval := range d.intervals {
+		mean += float64(interval)
+	}
+	mean /= float64(len(d.intervals))
+	var variance float64
+	for _, interval := range d.intervals {
+		variance += (float64(interval) - mean) * (float64(interval) - mean)
+	}
+	variance /= float64(len(d.intervals))
+	stdDev := max(math.Sqrt(variance), float64(d.minStdDev))
+
+	return phi(float64(t.Sub(d.last)), mean, stdDev), d.threshold
+}
+
+// phi returns -log10 of the probability that a normally distributed
+// interval is longer than elapsed, using the logistic approximation of
+// the normal distribution's tail
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// SuspicionEvent reports that a backup started or stopped suspecting its
+// primary
+type SuspicionEvent struct {
+	Time      time.Time
+	Peer      string // address of the primary
+	Detector  string // name of the detection strategy
+	Level     float64
+	Threshold float64
+	Suspected bool // true when suspicion reached the threshold, false when it cleared
+}
+
+// String formats the event as key=value pairs for logging
+func (e SuspicionEvent) String() string {
+	return fmt.Sprintf("time=%s peer=%s detector=%s level=%.2f threshold=%.2f suspected=%t",
+		e.Time.Format(time.RFC3339Nano), e.Peer, e.Detector, e.Level, e.Threshold, e.Suspected)
+}
+
+// heartbeat is the persistent connection a backup pings its primary on
+type heartbeat struct {
+	addr    string
+	timeout time.Duration
+	conn    net.Conn
+	decoder *protocol.Decoder
+	lastID  uint64
+}
+
+var errUnexpectedReply = errors.New("unexpected reply to PING")
+
+// ping sends a PING stamped with epoch and waits for the matching PONG. It
+// returns the epoch of the PONG. A late PONG to an earlier PING is skipped.
+// The connection is only dropped if it fails, not on a timeout.
+func (h *heartbeat) ping(epoch uint64) (uint64, error) {
+	if h.conn == nil {
+		conn, err := net.DialTimeout("tcp", h.addr, h.timeout)
+		if err != nil {
+			return 0, err
+		}
+		h.conn = conn
+		h.decoder = protocol.NewDecoder(conn)
+	}
+
+	h.lastID++
+	h.conn.SetDeadline(time.Now().Add(h.timeout))
+	err := protocol.Write(h.conn, &protocol.Packet{Type: protocol.PING, ID: h.lastID, Epoch: epoch})
+	for err == nil {
+		var response *protocol.Packet
+		response, err = h.decoder.Decode()
+		if err != nil {
+			break
+		}
+		if response.Type == protocol.PONG && response.ID == h.lastID {
+			return response.Epoch, nil
+		}
+		if response.Type != protocol.PONG {
+			// A primary that rejects our epoch answers ACK and hangs up
+			err = errUnexpectedReply
+		}
+	}
+
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		h.close()
+	}
+	return 0, err
+}
+
+// close drops the connection; the next ping reconnects
+func (h *heartbeat) close() {
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
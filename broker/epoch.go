@@ -0,0 +1,68 @@
+package broker
+
+import (
+	"fmt"
+
+	"go-broker/protocol"
+)
+
+// Epoch returns the leadership epoch this broker knows about. A backup
+// increments it when it takes over; the highest epoch names the broker in
+// charge.
+func (b *Broker) Epoch() uint64 {
+	return b.epoch.Load()
+}
+
+// stamp sets the broker's epoch on a packet it sends
+func (b *Broker) stamp(p *protocol.Packet) *protocol.Packet {
+	p.Epoch = b.epoch.Load()
+	return p
+}
+
+// observeEpoch handles an epoch seen on an incoming packet. A newer epoch
+// means another broker took over: it is adopted, and if this broker is
+// serving publishes it steps down.
+func (b *Broker) observeEpoch(epoch uint64) {
+	for {
+		current := b.epoch.Load()
+		if epoch <= current {
+			return
+		}
+		if b.epoch.CompareAndSwap(current, epoch) {
+			break
+		}
+	}
+
+	switch b.config.Role {
+	case Primary:
+		if b.fenced.Swap(true) {
+			return
+		}
+		fmt.Printf("⚠️  Epoch %d replaced us: stepping down and refusing writes\n", epoch)
+		b.backupMu.Lock()
+		if b.backupConn != nil {
+			b.backupConn.Close()
+		}
+		b.backupMu.Unlock()
+	case Backup:
+		b.primaryAliveMu.Lock()
+		if !b.primaryAlive {
+			fmt.Printf("✓ Primary is back online with epoch %d: back to standby\n", epoch)
+			b.primaryAlive = true
+		}
+		b.primaryAliveMu.Unlock()
+	}
+}
+
+// takeOver starts a new epoch for a backup that takes over from its
+// primary. It is at least 2, so it replaces a primary that just started at
+// epoch 1 even if the backup never heard from it.
+func (b *Broker) takeOver() uint64 {
+	for {
+		current := b.epoch.Load()
+		next := max(current, 1) + 1
+		if b.epoch.CompareAndSwap(current, next) {
+			return next
+		}
+	}
+}
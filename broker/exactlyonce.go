@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"fmt"
+
+	"go-broker/protocol"
+)
+
+// releaseKey identifies a QoS 2 publish: packet IDs are scoped to the
+// publishing client
+func releaseKey(p *protocol.Packet) string {
+	return fmt.Sprintf("%s/%d", p.ClientID, p.ID)
+}
+
+// recordReceived marks a QoS 2 publish as received. It returns false if the
+// packet ID is already awaiting its PUBREL, i.e. the publish is a duplicate.
+func (b *Broker) recordReceived(p *protocol.Packet) bool {
+	b.pendingReleasesMu.Lock()
+	defer b.pendingReleasesMu.Unlock()
+
+	key := releaseKey(p)
+	if _, ok := b.pendingReleases[key]; ok {
+		return false
+	}
+	b.pendingReleases[key] = struct{}{}
+	return true
+}
+
+// releaseReceived forgets a QoS 2 packet ID
+func (b *Broker) releaseReceived(p *protocol.Packet) {
+	b.pendingReleasesMu.Lock()
+	delete(b.pendingReleases, releaseKey(p))
+	b.pendingReleasesMu.Unlock()
+}
+
+// handlePubrec records a QoS 2 packet ID the primary has received but not
+// yet released. Primaries send these in the snapshot for their backup.
+func (b *Broker) handlePubrec(packet Packet) {
+	if packet.ID == 0 || packet.ClientID == "" {
+		return
+	}
+	b.recordReceived(packet.Packet)
+}
+
+// handlePubrel forgets a released QoS 2 packet ID and completes the
+// exchange with PUBCOMP. The primary forwards the release so the backup
+// can keep deduplicating after a failover.
+func (b *Broker) handlePubrel(packet Packet) {
+	b.releaseReceived(packet.Packet)
+
+	if b.replicating() {
+		b.sendToBackup(&protocol.Packet{Type: protocol.PUBREL, ID: packet.ID, ClientID: packet.ClientID})
+	}
+
+	// A passive backup only sees releases forwarded by the primary
+	if !b.acceptsPublish() {
+		return
+	}
+	reply(packet, b.stamp(&protocol.Packet{Type: protocol.PUBCOMP, ID: packet.ID, ClientID: packet.ClientID}))
+	fmt.Printf("Released message %d of client '%s'\n", packet.ID, packet.ClientID)
+}
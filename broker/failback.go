@@ -0,0 +1,148 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go-broker/protocol"
+)
+
+var (
+	errNotInCharge     = errors.New("failback needs a backup that has taken over")
+	errFailbackRefused = errors.New("primary did not take over")
+)
+
+// failbackTimeout bounds each step of the handover
+const failbackTimeout = 5 * time.Second
+
+// Failback hands leadership from a backup in charge back to its recovered
+// primary. The backup stops accepting publishes, sends the primary a
+// snapshot of its unprocessed messages, subscriptions and sequence number,
+// and once the primary has applied it, tells it to take over with a new
+// epoch. Only then does the backup return to standby and redirect its
+// clients to the primary. If any step fails, the backup stays in charge.
+func (b *Broker) Failback() error {
+	if b.config.Role != Backup || !b.acceptsPublish() {
+		return errNotInCharge
+	}
+	result := make(chan error, 1)
+	select {
+	case b.failbacks <- result:
+	case <-b.done:
+		return net.ErrClosed
+	}
+	return <-result
+}
+
+// failback runs the handover. It is called by the application logic
+// goroutine, so no publish is handed to the compute workers meanwhile.
+func (b *Broker) failback() error {
+	conn, err := net.DialTimeout("tcp", b.config.PeerAddr, failbackTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	decoder := protocol.NewDecoder(conn)
+
+	// Publishes that arrive from now on are refused, and those still
+	// queued are left unprocessed, so they are part of the snapshot
+	b.fenced.Store(true)
+	fmt.Printf("Failing back to primary at %s...\n", b.config.PeerAddr)
+
+	// Publishes the workers are processing are delivered by us
+	b.drainCompute()
+
+	b.subscriberMu.Lock()
+	b.pendingReleasesMu.Lock()
+	b.unprocessedMu.Lock()
+	pending := len(b.unprocessed.messages)
+	err = b.writeSnapshot(conn)
+	b.unprocessedMu.Unlock()
+	b.pendingReleasesMu.Unlock()
+	b.subscriberMu.Unlock()
+	if err == nil {
+		err = awaitHandover(conn, decoder, protocol.SNAPSHOT, 0)
+	}
+
+	epoch := b.epoch.Load() + 1
+	if err == nil {
+		err = protocol.Write(conn, &protocol.Packet{Type: protocol.FAILBACK, Epoch: epoch})
+	}
+	if err == nil {
+		err = awaitHandover(conn, decoder, protocol.ACK, epoch)
+	}
+	if err != nil {
+		b.fenced.Store(false)
+		return fmt.Errorf("failback aborted, staying in charge: %w", err)
+	}
+
+	// The primary is in charge: back to standby
+	b.epoch.Store(epoch)
+	b.primaryAliveMu.Lock()
+	b.primaryAlive = true
+	b.primaryAliveMu.Unlock()
+	b.unprocessedMu.Lock()
+	b.unprocessed = pendingLog{}
+	b.unprocessedMu.Unlock()
+	b.fenced.Store(false)
+
+	b.redirectClients()
+	fmt.Printf("✓ Failback complete: primary is in charge at epoch %d (%d unprocessed messages handed over)\n", epoch, pending)
+	return nil
+}
+
+// awaitHandover waits for the primary's reply of the given type. An ACK
+// must carry epoch; any other ACK that does not acknowledge a replicated
+// message is the primary refusing the handover.
+func awaitHandover(conn net.Conn, decoder *protocol.Decoder, want protocol.PacketType, epoch uint64) error {
+	conn.SetReadDeadline(time.Now().Add(failbackTimeout))
+	for {
+		response, err := decoder.Decode()
+		if err != nil {
+			return err
+		}
+		if response.Type == want && (want != protocol.ACK || response.Epoch == epoch) {
+			return nil
+		}
+		if response.Type == protocol.ACK && response.Seq == 0 {
+			return errFailbackRefused
+		}
+	}
+}
+
+// redirectClients tells every client connected to a backup that went back
+// to standby to use the primary, and closes their connections
+func (b *Broker) redirectClients() {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+	for conn, c := range b.clients {
+		redirect := &protocol.Packet{Type: protocol.DISCONNECT, Topic: b.config.PeerAddr}
+		if !c.legacy {
+			c.send(b.stamp(redirect))
+		}
+		// The writer closes the connection once the redirect is written
+		c.out.finish()
+		fmt.Printf("Redirected %s to %s\n", conn.RemoteAddr(), b.config.PeerAddr)
+	}
+}
+
+// handleFailback makes a recovered primary that stepped down the broker in
+// charge again, after a backup sent it its state
+func (b *Broker) handleFailback(packet Packet) {
+	if b.config.Role != Primary || !b.fenced.Load() || packet.Epoch <= b.epoch.Load() {
+		fmt.Printf("Ignoring FAILBACK to epoch %d from %s\n", packet.Epoch, packet.conn.RemoteAddr())
+		reply(packet, b.stamp(&protocol.Packet{Type: protocol.ACK}))
+		return
+	}
+
+	b.epoch.Store(packet.Epoch)
+	b.fenced.Store(false)
+	fmt.Printf("✓ Taking back over with epoch %d\n", packet.Epoch)
+	reply(packet, b.stamp(&protocol.Packet{Type: protocol.ACK}))
+
+	// Deliver what the backup handed over, then replicate to it again
+	go b.processReplicatedMessages()
+	go b.connectBackup()
+}
@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+
+	"go-broker/protocol"
+)
+
+// handleSubscribe adds a subscriber to the topic filter
+func (b *Broker) handleSubscribe(packet Packet) {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+
+	// Legacy clients cannot acknowledge deliveries
+	qos := min(packet.QoS(), protocol.AtLeastOnce)
+	c := b.clientFor(packet.conn, packet.Legacy)
+	if c.legacy {
+		qos = protocol.AtMostOnce
+	}
+
+	s := c.session
+	if granted, ok := s.filters[packet.Topic]; !ok || granted != qos {
+		s.filters[packet.Topic] = qos
+		b.topics.subscribe(packet.Topic, s, qos)
+		b.replicateSession(s, sessionSubscribe, packet.Topic, qos)
+		fmt.Printf("Subscriber added for topic '%s' (QoS %d) from %s\n", packet.Topic, qos, packet.conn.RemoteAddr())
+	}
+
+	// A passive backup leaves retained delivery to the primary
+	if !b.acceptsPublish() {
+		return
+	}
+	for topic, message := range b.retained {
+		if !matchTopic(packet.Topic, topic) {
+			continue
+		}
+		if err := b.deliver(s, message, qos); err != nil {
+			fmt.Println("Error writing retained message to subscriber:", err)
+			return
+		}
+		fmt.Printf("Sent retained message for topic '%s' to %s\n", topic, packet.conn.RemoteAddr())
+	}
+}
+
+// handleUnsubscribe removes a single topic filter of a subscriber
+func (b *Broker) handleUnsubscribe(packet Packet) {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+
+	c, ok := b.clients[packet.conn]
+	if !ok {
+		return
+	}
+	s := c.session
+	if _, ok := s.filters[packet.Topic]; !ok {
+		return
+	}
+	delete(s.filters, packet.Topic)
+
+	b.topics.unsubscribe(packet.Topic, s)
+	b.replicateSession(s, sessionUnsubscribe, packet.Topic, 0)
+	fmt.Printf("Subscriber removed from topic '%s': %s\n", packet.Topic, packet.conn.RemoteAddr())
+}
+
+// deliverPublish forwards the messages the processors returned for a
+// publish to all subscribers of their topics. packet.conn is nil for
+// messages replayed by a backup taking over.
+func (b *Broker) deliverPublish(result computed) {
+	packet, messages := result.packet, result.messages
+	defer b.computing.Add(-1)
+	if len(messages) == 0 {
+		fmt.Printf("Message to topic '%s' dropped by processing\n", packet.Topic)
+	}
+
+	b.subscriberMu.Lock()
+	var failed []net.Conn
+	for _, m := range messages {
+		// Live deliveries never carry the retain flag, only replays on SUBSCRIBE do
+		message := &protocol.Packet{Type: protocol.PUBLISH, Topic: m.Topic, Payload: m.Payload, Headers: m.Headers}
+		if m.Retain {
+			b.storeRetained(message)
+		}
+		subscribers := b.topics.match(m.Topic)
+
+		fmt.Printf("Publishing message to topic '%s': %s (subscribers: %d)\n", m.Topic, m.Payload, len(subscribers))
+
+		for s, qos := range subscribers {
+			err := b.deliver(s, message, qos)
+			if err != nil {
+				fmt.Println("Error writing to subscriber:", err)
+				failed = append(failed, s.client.conn)
+			}
+		}
+	}
+	b.subscriberMu.Unlock()
+
+	for _, conn := range failed {
+		b.handleDisconnect(conn)
+	}
+
+	// If Primary, clear message from backup. The backup mirrors what was
+	// delivered, so it gets a CLEAR for every processed message, or one
+	// without a topic if processing dropped it.
+	if packet.Seq != 0 {
+		b.forgetReplicated(packet.Seq)
+	}
+	if b.replicating() && packet.Seq != 0 {
+		for _, m := range messages {
+			cleared := &protocol.Packet{Type: protocol.CLEAR, Topic: m.Topic, Payload: m.Payload, Headers: m.Headers, Seq: packet.Seq}
+			if m.Retain {
+				cleared.Flags |= protocol.FlagRetain
+			}
+			b.sendToBackup(cleared)
+		}
+		if len(messages) == 0 {
+			b.sendToBackup(&protocol.Packet{Type: protocol.CLEAR, Seq: packet.Seq})
+		}
+	}
+
+	if b.wal != nil && packet.Seq != 0 {
+		if err := b.wal.MarkProcessed(packet.Seq); err != nil {
+			fmt.Println("Error writing to WAL:", err)
+		}
+	}
+
+	// One-shot publishers disconnect after sending, which counts as a
+	// clean goodbye
+	if packet.oneShot() {
+		b.handleDisconnect(packet.conn)
+		fmt.Println("Publisher disconnected:", packet.conn.RemoteAddr())
+	}
+}
+
+// storeRetained updates the retained message of a topic from a retained
+// PUBLISH. An empty payload clears it. The caller must hold subscriberMu.
+func (b *Broker) storeRetained(p *protocol.Packet) {
+	if len(p.Payload) == 0 {
+		delete(b.retained, p.Topic)
+		fmt.Printf("Cleared retained message for topic '%s'\n", p.Topic)
+		return
+	}
+	b.retained[p.Topic] = &protocol.Packet{
+		Type:    protocol.PUBLISH,
+		Flags:   protocol.FlagRetain,
+		Topic:   p.Topic,
+		Payload: p.Payload,
+		Headers: p.Headers,
+	}
+	fmt.Printf("Stored retained message for topic '%s'\n", p.Topic)
+}
+
+// handleConnect registers the Last Will and Testament of a connection and,
+// if it carries a client ID, attaches it to that client's persistent session
+func (b *Broker) handleConnect(packet Packet) {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+
+	c := b.clientFor(packet.conn, packet.Legacy)
+
+	if packet.Topic != "" {
+		c.will = &protocol.Packet{
+			Type:    protocol.PUBLISH,
+			Flags:   packet.Flags & protocol.FlagRetain,
+			Topic:   packet.Topic,
+			Payload: packet.Payload,
+			Headers: packet.Headers,
+		}
+		fmt.Printf("Registered will for topic '%s' from %s\n", packet.Topic, packet.conn.RemoteAddr())
+	}
+
+	if packet.ClientID != "" {
+		if err := b.resume(c, packet.ClientID); err != nil {
+			fmt.Println("Error resuming session:", err)
+			packet.conn.Close()
+		}
+	}
+}
+
+// handleGoodbye discards the will of a connection that said DISCONNECT and
+// closes it
+func (b *Broker) handleGoodbye(packet Packet) {
+	b.subscriberMu.Lock()
+	if c, ok := b.clients[packet.conn]; ok {
+		c.will = nil
+	}
+	b.subscriberMu.Unlock()
+
+	fmt.Println("Client disconnected cleanly:", packet.conn.RemoteAddr())
+	b.handleDisconnect(packet.conn)
+}
+
+// publishWill publishes the will of a connection that dropped without a
+// DISCONNECT. A passive backup leaves this to the primary.
+func (b *Broker) publishWill(conn net.Conn) {
+	var will *protocol.Packet
+	b.subscriberMu.Lock()
+	if c, ok := b.clients[conn]; ok {
+		will = c.will
+		c.will = nil
+	}
+	b.subscriberMu.Unlock()
+
+	if will == nil || !b.acceptsPublish() {
+		return
+	}
+
+	fmt.Printf("Connection %s dropped, publishing its will to topic '%s'\n", conn.RemoteAddr(), will.Topic)
+	if err := b.logPublish(will); err != nil {
+		fmt.Println("Error writing to WAL:", err)
+	}
+	if b.replicating() && will.Seq != 0 {
+		b.sendToBackup(b.trackReplicated(will))
+	}
+	b.handlePublish(Packet{Packet: will})
+}
+
+// handleDisconnect detaches a connection from its session. Subscriptions
+// and in-flight deliveries of persistent sessions are kept for the next
+// connection with the same client ID; all others are dropped.
+func (b *Broker) handleDisconnect(conn net.Conn) {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+
+	if c, ok := b.clients[conn]; ok {
+		b.detach(c)
+		delete(b.clients, conn)
+		if dropped := c.out.drops(); dropped > 0 {
+			fmt.Printf("Dropped %d packets to slow client %s (%s)\n", dropped, conn.RemoteAddr(), b.config.OverflowPolicy)
+		}
+		c.out.stop()
+	}
+	conn.Close()
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// logPublish assigns the next sequence number to an accepted PUBLISH. With
+// a write-ahead log the message is appended to it and the log assigns the
+// number; otherwise an in-memory counter does.
+func (b *Broker) logPublish(p *protocol.Packet) error {
+	if b.wal == nil {
+		p.Seq = b.lastSeq.Add(1)
+		return nil
+	}
+	seq, err := b.wal.Append(p)
+	if err != nil {
+		return err
+	}
+	p.Seq = seq
+	b.advanceSeq(seq)
+	return nil
+}
+
+// advanceSeq moves the sequence counter up to seq, so a backup that takes
+// over continues numbering after the primary's last message. The
+// write-ahead log, which numbers messages when there is one, moves along.
+func (b *Broker) advanceSeq(seq uint64) {
+	if b.wal != nil {
+		b.wal.Advance(seq)
+	}
+	for {
+		last := b.lastSeq.Load()
+		if seq <= last || b.lastSeq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// recoverLog takes the messages found unprocessed in the write-ahead log on
+// startup. A primary tracks them as replicated, so its backup gets them in
+// the snapshot when it attaches, before they are processed and cleared.
+func (b *Broker) recoverLog() []*protocol.Packet {
+	var messages []*protocol.Packet
+	for _, record := range b.recovered {
+		message := &protocol.Packet{
+			Type:    protocol.PUBLISH,
+			Flags:   record.Packet.Flags,
+			Topic:   record.Packet.Topic,
+			Payload: record.Packet.Payload,
+			Headers: record.Packet.Headers,
+			Seq:     record.Seq,
+		}
+		if b.config.Role == Primary {
+			b.trackReplicated(message)
+		}
+		messages = append(messages, message)
+	}
+	b.recovered = nil
+	return messages
+}
+
+// replayLog hands the recovered messages to the application logic, oldest
+// first, after RecoveryDelay. Subscriptions only live in memory, so the
+// delay gives subscribers time to reconnect after a restart. The messages
+// are marked processed once delivered, like any newly logged publish.
+func (b *Broker) replayLog(messages []*protocol.Packet) {
+	fmt.Printf("Recovering %d unprocessed messages from the write-ahead log in %s...\n", len(messages), b.config.RecoveryDelay)
+	select {
+	case <-time.After(b.config.RecoveryDelay):
+	case <-b.done:
+		return
+	}
+	fmt.Printf("Replaying %d messages from the write-ahead log\n", len(messages))
+
+	for _, message := range messages {
+		select {
+		case b.packets <- Packet{Packet: message}:
+		case <-b.done:
+			return
+		}
+	}
+}
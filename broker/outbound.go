@@ -0,0 +1,232 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// OverflowPolicy selects what happens to a delivery when the outbound queue
+// of a client is full
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued packet to make room.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the packet that does not fit.
+	DropNewest
+	// Disconnect closes the connection of the client.
+	Disconnect
+	// Block makes the application logic wait until there is room, which
+	// holds up every publisher until the client catches up.
+	Block
+)
+
+// String returns the name accepted by ParseOverflowPolicy
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Disconnect:
+		return "disconnect"
+	case Block:
+		return "block"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy looks up an overflow policy by name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for _, p := range []OverflowPolicy{DropOldest, DropNewest, Disconnect, Block} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q (want drop-oldest, drop-newest, disconnect or block)", name)
+}
+
+var (
+	errQueueFull     = errors.New("outbound queue full")
+	errWriterStopped = errors.New("connection closed")
+)
+
+// outbound is the queue of packets waiting to be written to a client. Each
+// client has a writer goroutine draining it, so a slow client only holds
+// up itself.
+type outbound struct {
+	name  string         // remote address, for logging
+	total *atomic.Uint64 // drops of all clients
+
+	mu          sync.Mutex
+	packets     []*protocol.Packet // oldest first
+	limit       int
+	policy      OverflowPolicy
+	closing     bool   // close the connection once the queue is written
+	stopped     bool   // nothing more is written
+	dropped     uint64 // packets discarded by the overflow policy
+	overflowing bool   // dropping since the queue was last empty
+
+	ready chan struct{} // a packet was queued, or closing or stopped set
+	space chan struct{} // a packet was taken off the queue
+	done  chan struct{} // closed when the writer has ended
+}
+
+func newOutbound(name string, limit int, policy OverflowPolicy, total *atomic.Uint64) *outbound {
+	return &outbound{
+		name:   name,
+		total:  total,
+		limit:  limit,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// signal wakes up whoever waits on ch, without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push queues a packet for the writer, applying the overflow policy if the
+// queue is full. Dropping a packet is not an error.
+func (o *outbound) push(p *protocol.Packet) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for !o.stopped && !o.closing && len(o.packets) >= o.limit {
+		switch o.policy {
+		case DropNewest:
+			o.drop()
+			return nil
+		case Disconnect:
+			return errQueueFull
+		case Block:
+			o.mu.Unlock()
+			select {
+			case <-o.space:
+			case <-o.done:
+			}
+			o.mu.Lock()
+			continue
+		}
+		o.packets[0] = nil
+		o.packets = o.packets[1:]
+		o.drop()
+	}
+	if o.stopped || o.closing {
+		return errWriterStopped
+	}
+
+	o.packets = append(o.packets, p)
+	signal(o.ready)
+	return nil
+}
+
+// drop counts a packet discarded by the overflow policy. The first drop
+// since the queue was last empty is logged. The caller must hold mu.
+func (o *outbound) drop() {
+	o.dropped++
+	o.total.Add(1)
+	if !o.overflowing {
+		o.overflowing = true
+		fmt.Printf("⚠️  Outbound queue of %s is full (%d packets), applying %s\n", o.name, o.limit, o.policy)
+	}
+}
+
+// next waits for the packet to write next. It returns nil once the writer
+// should end, and whether the connection should be closed then.
+func (o *outbound) next(done <-chan struct{}) (*protocol.Packet, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for len(o.packets) == 0 {
+		o.overflowing = false
+		if o.stopped || o.closing {
+			return nil, o.closing
+		}
+		o.mu.Unlock()
+		select {
+		case <-o.ready:
+		case <-done:
+			o.mu.Lock()
+			o.stopped = true
+			return nil, false
+		}
+		o.mu.Lock()
+	}
+	if o.stopped {
+		return nil, false
+	}
+
+	p := o.packets[0]
+	o.packets[0] = nil
+	o.packets = o.packets[1:]
+	signal(o.space)
+	return p, false
+}
+
+// finish lets the writer write what is queued and then close the connection
+func (o *outbound) finish() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closing = true
+	signal(o.ready)
+}
+
+// stop ends the writer without writing what is queued
+func (o *outbound) stop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stopped = true
+	o.packets = nil
+	signal(o.ready)
+}
+
+// drops returns the number of packets discarded by the overflow policy
+func (o *outbound) drops() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dropped
+}
+
+// writeLoop writes the outbound queue of a client to its connection until
+// the client is stopped or a write fails. A failed write closes the
+// connection, so its reader reports the drop to the application logic.
+func (b *Broker) writeLoop(c *client) {
+	defer close(c.out.done)
+	for {
+		p, closeConn := c.out.next(b.done)
+		if p == nil {
+			if closeConn {
+				c.conn.Close()
+			}
+			return
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(b.config.WriteTimeout))
+		var err error
+		if c.legacy {
+			err = protocol.WriteLegacy(c.conn, p)
+		} else {
+			err = protocol.Write(c.conn, p)
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Error writing to %s: %v\n", c.conn.RemoteAddr(), err)
+			}
+			c.out.stop()
+			c.conn.Close()
+			return
+		}
+	}
+}
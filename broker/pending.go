@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"sort"
+
+	"go-broker/protocol"
+)
+
+// pendingLog holds the messages a backup received in REPLICATE and has not
+// seen cleared yet, ordered by the primary's sequence number
+type pendingLog struct {
+	messages []*protocol.Packet // ascending Seq
+}
+
+// search returns the index of seq, or where it would be inserted
+func (l *pendingLog) search(seq uint64) int {
+	return sort.Search(len(l.messages), func(i int) bool { return l.messages[i].Seq >= seq })
+}
+
+// add stores p under p.Seq, replacing a message with the same sequence number
+func (l *pendingLog) add(p *protocol.Packet) {
+	// Sequence numbers normally arrive in order: append
+	if n := len(l.messages); n == 0 || l.messages[n-1].Seq < p.Seq {
+		l.messages = append(l.messages, p)
+		return
+	}
+
+	i := l.search(p.Seq)
+	if i < len(l.messages) && l.messages[i].Seq == p.Seq {
+		l.messages[i] = p
+		return
+	}
+	l.messages = append(l.messages, nil)
+	copy(l.messages[i+1:], l.messages[i:])
+	l.messages[i] = p
+}
+
+// remove drops the message with sequence number seq and reports whether it
+// was pending
+func (l *pendingLog) remove(seq uint64) bool {
+	i := l.search(seq)
+	if i == len(l.messages) || l.messages[i].Seq != seq {
+		return false
+	}
+	copy(l.messages[i:], l.messages[i+1:])
+	l.messages[len(l.messages)-1] = nil
+	l.messages = l.messages[:len(l.messages)-1]
+	return true
+}
+
+// drain removes and returns all pending messages in sequence order
+func (l *pendingLog) drain() []*protocol.Packet {
+	messages := l.messages
+	l.messages = nil
+	return messages
+}
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Message is a published message as processors see it
+type Message struct {
+	Topic   string
+	Payload []byte
+	Headers map[string]string
+	Retain  bool
+}
+
+// Processor handles published messages before they are delivered. Process
+// returns the messages to deliver in place of m: m itself, changed or not,
+// several messages to fan it out, or none to drop it. An error drops m.
+//
+// Processors are called by the compute workers. Messages with different
+// ordering keys are processed concurrently, so a processor shared by
+// several topics must be safe for concurrent use.
+type Processor interface {
+	Process(m Message) ([]Message, error)
+}
+
+// ProcessorFunc adapts a function to a Processor
+type ProcessorFunc func(m Message) ([]Message, error)
+
+// Process calls f(m)
+func (f ProcessorFunc) Process(m Message) ([]Message, error) {
+	return f(m)
+}
+
+// ProcessorRoute applies a processor to the messages whose topic matches a
+// topic filter
+type ProcessorRoute struct {
+	Filter    string
+	Processor Processor
+}
+
+// Defaults of the pseudo computing
+const (
+	DefaultComputeMin = 50 * time.Millisecond
+	DefaultComputeMax = 150 * time.Millisecond
+)
+
+// PseudoCompute simulates edge computing by sleeping for a uniformly
+// distributed time between Min and Max. Messages pass unchanged.
+type PseudoCompute struct {
+	Min, Max time.Duration
+}
+
+// Process sleeps and returns m
+func (p PseudoCompute) Process(m Message) ([]Message, error) {
+	computeTime := p.Min
+	if p.Max > p.Min {
+		computeTime += time.Duration(rand.Int63n(int64(p.Max - p.Min + 1)))
+	}
+	fmt.Printf("Computing for %d ms...\n", computeTime.Milliseconds())
+	time.Sleep(computeTime)
+	return []Message{m}, nil
+}
+
+var errNoProcessor = errors.New("processor route without a processor")
+
+// validateProcessors checks the filters and processors of the routes
+func validateProcessors(routes []ProcessorRoute) error {
+	for _, route := range routes {
+		if err := validateFilter(route.Filter); err != nil {
+			return fmt.Errorf("processor filter %q: %w", route.Filter, err)
+		}
+		if route.Processor == nil {
+			return fmt.Errorf("processor filter %q: %w", route.Filter, errNoProcessor)
+		}
+	}
+	return nil
+}
+
+// process runs a published message through the processors whose filters
+// match its topic, in the order they were configured. The messages a
+// processor returns go on to the processors after it.
+func (b *Broker) process(m Message) []Message {
+	messages := []Message{m}
+	for _, route := range b.config.Processors {
+		var next []Message
+		for _, m := range messages {
+			if !matchTopic(route.Filter, m.Topic) {
+				next = append(next, m)
+				continue
+			}
+			out, err := route.Processor.Process(m)
+			if err != nil {
+				fmt.Printf("Error processing message to topic '%s': %v\n", m.Topic, err)
+				continue
+			}
+			for _, processed := range out {
+				if err := validateTopic(processed.Topic); err != nil {
+					fmt.Printf("Processor for '%s' returned an invalid topic '%s': %v\n", route.Filter, processed.Topic, err)
+					continue
+				}
+				next = append(next, processed)
+			}
+		}
+		messages = next
+	}
+	return messages
+}
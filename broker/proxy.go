@@ -0,0 +1,260 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// Packet represents a decoded packet together with the connection it arrived on
+type Packet struct {
+	conn net.Conn
+	*protocol.Packet
+}
+
+// oneShot reports whether a PUBLISH comes from a publisher that disconnects
+// after it: one that gave it no packet ID. Publishers that number their
+// messages keep the connection open and publish many on it, and QoS 2
+// publishers stay to send PUBREL.
+func (p Packet) oneShot() bool {
+	return p.conn != nil && p.Type == protocol.PUBLISH && p.ID == 0
+}
+
+// reply writes a response to the sender of packet in the format it used
+func reply(packet Packet, p *protocol.Packet) error {
+	if packet.Legacy {
+		return protocol.WriteLegacy(packet.conn, p)
+	}
+	return protocol.Write(packet.conn, p)
+}
+
+var (
+	errInvalidQoS      = errors.New("invalid QoS level")
+	errMissingPacketID = errors.New("QoS 2 packets need a packet ID and a client ID")
+	errMissingSeq      = errors.New("replication packets need a sequence number")
+	errMissingClientID = errors.New("session packets need a client ID")
+)
+
+// validatePacket checks the topic of packets coming from clients
+func validatePacket(p *protocol.Packet) error {
+	switch p.Type {
+	case protocol.PUBLISH:
+		if p.QoS() > protocol.ExactlyOnce {
+			return errInvalidQoS
+		}
+		if p.QoS() == protocol.ExactlyOnce && (p.ID == 0 || p.ClientID == "") {
+			return errMissingPacketID
+		}
+		return validateTopic(p.Topic)
+	case protocol.PUBREL:
+		if p.ID == 0 || p.ClientID == "" {
+			return errMissingPacketID
+		}
+	case protocol.REPLICATE, protocol.CLEAR:
+		if p.Seq == 0 {
+			return errMissingSeq
+		}
+	case protocol.SESSION:
+		if p.ClientID == "" {
+			return errMissingClientID
+		}
+	case protocol.SUBSCRIBE, protocol.UNSUBSCRIBE:
+		return validateFilter(p.Topic)
+	case protocol.CONNECT:
+		if p.Topic != "" {
+			return validateTopic(p.Topic)
+		}
+	}
+	return nil
+}
+
+// proxy accepts new connections and starts a reader goroutine for each
+func (b *Broker) proxy() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if b.closed() {
+				return
+			}
+			// Out of file descriptors or similar: give it a moment
+			fmt.Println("Error accepting connection:", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		fmt.Println("New connection from:", conn.RemoteAddr())
+		if !b.track(conn) {
+			conn.Close()
+			return
+		}
+		go b.readConn(conn)
+	}
+}
+
+// acceptRetryDelay is the pause after a failed Accept
+const acceptRetryDelay = 10 * time.Millisecond
+
+// track records an open connection so Close can close it. It returns false
+// once the broker is closed.
+func (b *Broker) track(conn net.Conn) bool {
+	b.connsMu.Lock()
+	defer b.connsMu.Unlock()
+	if b.closed() {
+		return false
+	}
+	b.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack forgets a connection whose reader ended
+func (b *Broker) untrack(conn net.Conn) {
+	b.connsMu.Lock()
+	defer b.connsMu.Unlock()
+	delete(b.conns, conn)
+}
+
+// closeConnections closes every open connection, which ends their readers
+func (b *Broker) closeConnections() {
+	b.connsMu.Lock()
+	defer b.connsMu.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// dropped hands a connection that failed to the application logic, which
+// publishes its will
+func (b *Broker) dropped(conn net.Conn) {
+	select {
+	case b.closeConns <- conn:
+	case <-b.done:
+	}
+}
+
+// readConn reads the packets of one connection, answers what the proxy
+// answers itself and funnels the rest into the application logic. It blocks
+// in the read, so an idle connection costs nothing. It returns when the
+// connection fails or no more packets are expected on it.
+func (b *Broker) readConn(conn net.Conn) {
+	defer b.untrack(conn)
+
+	decoder := protocol.NewDecoder(conn)
+	for {
+		decoded, err := decoder.Decode()
+		if err != nil {
+			// Connection closed, real error or malformed packet
+			if err != io.EOF && !b.closed() {
+				fmt.Println("Error reading from client:", err)
+			}
+			b.dropped(conn)
+			return
+		}
+
+		// Got a packet
+		packet := Packet{conn: conn, Packet: decoded}
+
+		// Raft traffic between cluster members is answered right away
+		if decoded.Type == protocol.RAFT {
+			if err := b.handleRaft(packet); err != nil {
+				fmt.Printf("Rejecting RAFT from %s: %v\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			continue
+		}
+		fmt.Printf("Received from %s: %s\n", conn.RemoteAddr(), decoded)
+
+		if err := validatePacket(decoded); err != nil {
+			fmt.Printf("Rejecting %s from %s: %v\n", decoded.Type, conn.RemoteAddr(), err)
+			b.dropped(conn)
+			return
+		}
+
+		// A packet stamped with an older epoch comes from a leader that
+		// has been replaced: refuse it and tell the sender our epoch
+		if current := b.epoch.Load(); decoded.Epoch != 0 && decoded.Epoch < current {
+			fmt.Printf("Rejecting %s from %s: stale epoch %d (current %d)\n", decoded.Type, conn.RemoteAddr(), decoded.Epoch, current)
+			reply(packet, b.stamp(&protocol.Packet{Type: protocol.ACK}))
+			b.dropped(conn)
+			return
+		}
+		// FAILBACK carries the epoch we are yet to take over with
+		if decoded.Type != protocol.FAILBACK {
+			b.observeEpoch(decoded.Epoch)
+		}
+
+		// Handle PING from backup
+		if packet.Type == protocol.PING {
+			reply(packet, b.stamp(&protocol.Packet{Type: protocol.PONG, ID: packet.ID}))
+			continue
+		}
+
+		exactlyOnce := packet.Type == protocol.PUBLISH && packet.QoS() == protocol.ExactlyOnce
+
+		if packet.Type == protocol.PUBLISH && b.acceptsPublish() {
+			// A QoS 2 publish whose ID we already hold is a resend:
+			// acknowledge it again without processing it twice
+			if exactlyOnce && !b.recordReceived(packet.Packet) {
+				fmt.Printf("Duplicate message %d of client '%s' ignored\n", packet.ID, packet.ClientID)
+				reply(packet, b.stamp(&protocol.Packet{Type: protocol.PUBREC, ID: packet.ID, ClientID: packet.ClientID}))
+				continue
+			}
+
+			// Log the message before acknowledging it, so it survives a
+			// restart. Without an ACK the publisher will resend.
+			if err := b.logPublish(packet.Packet); err != nil {
+				fmt.Println("Error writing to WAL:", err)
+				if exactlyOnce {
+					b.releaseReceived(packet.Packet)
+				}
+				conn.Close()
+				return
+			}
+
+			// If Primary receives PUBLISH, replicate to backup first, and a
+			// cluster leader to a majority of the cluster. A message the
+			// replicas must have but did not confirm is rejected: no ACK,
+			// no delivery. A backup in charge only tracks it, for a
+			// failback.
+			if !b.replicating() {
+				b.trackReplicated(packet.Packet)
+			} else if !b.replicate(packet.Packet) {
+				fmt.Printf("Rejecting message #%d: backup did not acknowledge it\n", packet.Seq)
+				b.forgetReplicated(packet.Seq)
+				if b.wal != nil {
+					b.wal.MarkProcessed(packet.Seq)
+				}
+				if exactlyOnce {
+					b.releaseReceived(packet.Packet)
+				}
+				conn.Close()
+				return
+			}
+
+			// Send ACK to publisher, or PUBREC for QoS 2. The ACK carries
+			// the packet ID, so a publisher can send many messages before
+			// the first ACK arrives.
+			if exactlyOnce {
+				reply(packet, b.stamp(&protocol.Packet{Type: protocol.PUBREC, ID: packet.ID, ClientID: packet.ClientID}))
+			} else {
+				reply(packet, b.stamp(&protocol.Packet{Type: protocol.ACK, ID: packet.ID}))
+			}
+		}
+
+		select {
+		case b.packets <- packet:
+		case <-b.done:
+			return
+		}
+
+		// Stop reading from one-shot publishers after their packet. After
+		// a DISCONNECT the application logic closes the connection, so
+		// the resulting EOF must not be reported as an unclean drop.
+		if packet.oneShot() || packet.Type == protocol.DISCONNECT {
+			return
+		}
+	}
+}
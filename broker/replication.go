@@ -0,0 +1,401 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// ReplicationMode selects how long a primary waits for the backup before
+// acknowledging a publish
+type ReplicationMode int
+
+const (
+	// Async primaries ACK the publisher as soon as the REPLICATE is written.
+	Async ReplicationMode = iota
+	// Sync primaries ACK the publisher only after the backup acknowledged
+	// the REPLICATE. Without a reachable backup, publishes are rejected.
+	Sync
+	// SemiSync primaries wait up to Config.ReplicationTimeout for the
+	// backup and then ACK the publisher anyway.
+	SemiSync
+)
+
+// String returns the name accepted by ParseReplicationMode
+func (m ReplicationMode) String() string {
+	switch m {
+	case Async:
+		return "async"
+	case Sync:
+		return "sync"
+	case SemiSync:
+		return "semi-sync"
+	}
+	return fmt.Sprintf("ReplicationMode(%d)", int(m))
+}
+
+// ParseReplicationMode looks up a replication mode by name
+func ParseReplicationMode(name string) (ReplicationMode, error) {
+	for _, m := range []ReplicationMode{Async, Sync, SemiSync} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown replication mode %q (want async, sync or semi-sync)", name)
+}
+
+// connectBackup keeps a replication connection to the backup open. On every
+// (re)connect the backup first gets a snapshot of the primary's state and
+// then the live stream.
+func (b *Broker) connectBackup() {
+	if !b.connecting.CompareAndSwap(false, true) {
+		return
+	}
+	defer b.connecting.Store(false)
+
+	for !b.closed() && !b.fenced.Load() {
+		conn, err := net.Dial("tcp", b.config.PeerAddr)
+		if err == nil {
+			fmt.Println("Connected to backup broker at", b.config.PeerAddr)
+			if err = b.attachBackup(conn); err == nil {
+				b.readBackupAcks(conn)
+			} else {
+				conn.Close()
+			}
+		}
+		if b.closed() || b.fenced.Load() {
+			return
+		}
+		if err != nil {
+			fmt.Println("Failed to connect to backup, retrying in 2s:", err)
+		} else {
+			fmt.Println("Reconnecting to backup in 2s")
+		}
+		select {
+		case <-time.After(2 * time.Second):
+		case <-b.done:
+		}
+	}
+}
+
+// sendToBackup writes a replication packet to the backup, if connected. A
+// cluster leader appends it to the Raft log instead.
+func (b *Broker) sendToBackup(p *protocol.Packet) {
+	if b.cluster != nil {
+		if _, _, err := b.cluster.propose(p); err != nil {
+			fmt.Printf("Error replicating %s to the cluster: %v\n", p.Type, err)
+		}
+		return
+	}
+
+	b.backupMu.Lock()
+	defer b.backupMu.Unlock()
+
+	if b.backupConn == nil {
+		return
+	}
+	// A stalled backup is dropped rather than blocking replication. Its
+	// connection is reestablished with a fresh snapshot.
+	b.backupConn.SetWriteDeadline(time.Now().Add(b.config.WriteTimeout))
+	if err := protocol.Write(b.backupConn, b.stamp(p)); err != nil {
+		fmt.Println("Error replicating to backup:", err)
+		b.backupConn.Close()
+		b.backupConn = nil
+		b.backupHealthy = false
+	}
+}
+
+// trackReplicated returns the REPLICATE packet for an accepted PUBLISH and
+// remembers it as unprocessed until forgetReplicated, so a backup that
+// connects in between, or a primary taking back over, gets it in its
+// snapshot
+func (b *Broker) trackReplicated(p *protocol.Packet) *protocol.Packet {
+	message := &protocol.Packet{
+		Type:     protocol.REPLICATE,
+		Flags:    p.Flags,
+		Topic:    p.Topic,
+		Payload:  p.Payload,
+		Headers:  p.Headers,
+		ID:       p.ID,
+		ClientID: p.ClientID,
+		Seq:      p.Seq,
+	}
+	b.unprocessedMu.Lock()
+	b.unprocessed.add(message)
+	b.unprocessedMu.Unlock()
+	return message
+}
+
+// forgetReplicated drops a message from the unprocessed set. It must be
+// called before the CLEAR is sent, so a snapshot never resurrects it.
+func (b *Broker) forgetReplicated(seq uint64) {
+	b.unprocessedMu.Lock()
+	b.unprocessed.remove(seq)
+	b.unprocessedMu.Unlock()
+}
+
+// replicate sends a PUBLISH to the backup as REPLICATE and waits for the
+// backup's ACK as far as the replication mode asks for. It reports whether
+// the publisher may be acknowledged. A cluster leader waits until a
+// majority of the cluster stored the message.
+func (b *Broker) replicate(p *protocol.Packet) bool {
+	message := b.trackReplicated(p)
+	if b.cluster != nil {
+		return b.cluster.replicate(message)
+	}
+	if b.config.ReplicationMode == Async {
+		b.sendToBackup(message)
+		return true
+	}
+
+	acked := make(chan bool, 1)
+	b.backupAckMu.Lock()
+	b.backupAcks[p.Seq] = acked
+	b.backupAckMu.Unlock()
+	defer func() {
+		b.backupAckMu.Lock()
+		delete(b.backupAcks, p.Seq)
+		b.backupAckMu.Unlock()
+	}()
+
+	b.backupMu.Lock()
+	connected := b.backupConn != nil
+	b.backupMu.Unlock()
+	if connected {
+		b.sendToBackup(message)
+	}
+
+	var timeout <-chan time.Time
+	if b.config.ReplicationMode == SemiSync {
+		timer := time.NewTimer(b.config.ReplicationTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	ok := false
+	if connected {
+		select {
+		case ok = <-acked:
+		case <-timeout:
+		case <-b.done:
+		}
+	}
+	if !ok && b.config.ReplicationMode == SemiSync {
+		fmt.Printf("Backup did not acknowledge message #%d in time, continuing without it\n", p.Seq)
+		return true
+	}
+	return ok
+}
+
+// readBackupAcks reads the backup's acknowledgements of REPLICATE packets
+// until the replication connection fails
+func (b *Broker) readBackupAcks(conn net.Conn) {
+	decoder := protocol.NewDecoder(conn)
+	for {
+		response, err := decoder.Decode()
+		if err != nil {
+			break
+		}
+		// The backup answers replication from a replaced primary with
+		// its newer epoch
+		if response.Epoch > b.epoch.Load() {
+			b.observeEpoch(response.Epoch)
+			break
+		}
+		if response.Type == protocol.SNAPSHOT && string(response.Payload) == snapshotEnd {
+			b.backupMu.Lock()
+			b.backupHealthy = b.backupConn == conn
+			b.backupMu.Unlock()
+			fmt.Println("✓ Backup caught up with the snapshot and is healthy")
+			continue
+		}
+		if response.Type != protocol.ACK || response.Seq == 0 {
+			continue
+		}
+		b.backupAckMu.Lock()
+		if acked, ok := b.backupAcks[response.Seq]; ok {
+			acked <- true
+			delete(b.backupAcks, response.Seq)
+		}
+		b.backupAckMu.Unlock()
+	}
+
+	if !b.closed() {
+		fmt.Println("Lost replication connection to backup")
+	}
+	b.backupMu.Lock()
+	if b.backupConn == conn {
+		b.backupConn = nil
+		b.backupHealthy = false
+	}
+	b.backupMu.Unlock()
+	conn.Close()
+
+	// Nobody is going to acknowledge the waiting publishes
+	b.backupAckMu.Lock()
+	for seq, acked := range b.backupAcks {
+		acked <- false
+		delete(b.backupAcks, seq)
+	}
+	b.backupAckMu.Unlock()
+}
+
+// handleReplicate stores a message replicated by the primary under its
+// sequence number
+func (b *Broker) handleReplicate(packet Packet) {
+	b.replicatedMsgsMu.Lock()
+	b.replicatedMsgs.add(&protocol.Packet{
+		Type:     protocol.PUBLISH,
+		Flags:    packet.Flags,
+		Topic:    packet.Topic,
+		Payload:  packet.Payload,
+		Headers:  packet.Headers,
+		ID:       packet.ID,
+		ClientID: packet.ClientID,
+		Seq:      packet.Seq,
+	})
+	b.replicatedMsgsMu.Unlock()
+	b.advanceSeq(packet.Seq)
+
+	// Remember QoS 2 packet IDs so a publisher resending to us after a
+	// failover is deduplicated
+	if packet.QoS() == protocol.ExactlyOnce {
+		b.recordReceived(packet.Packet)
+	}
+	fmt.Printf("Replicated #%d: %s -> %s\n", packet.Seq, packet.Topic, packet.Payload)
+
+	// Tell the primary the message is safe here; a primary replicating
+	// synchronously holds the publisher's ACK until then. Messages from the
+	// Raft log have no sender to answer.
+	if packet.conn != nil && !packet.Legacy {
+		reply(packet, b.stamp(&protocol.Packet{Type: protocol.ACK, Seq: packet.Seq}))
+	}
+}
+
+// handleClear drops a replicated message after the primary processed it.
+// Processed retained messages are mirrored into the backup's retained set
+// and messages for offline persistent sessions into their queues. A CLEAR
+// without a topic stands for a message that processing dropped.
+func (b *Broker) handleClear(packet Packet) {
+	b.replicatedMsgsMu.Lock()
+	b.replicatedMsgs.remove(packet.Seq)
+	b.replicatedMsgsMu.Unlock()
+	if packet.Topic == "" {
+		fmt.Printf("Cleared #%d, dropped by processing\n", packet.Seq)
+		return
+	}
+	fmt.Printf("Cleared #%d: %s -> %s\n", packet.Seq, packet.Topic, packet.Payload)
+
+	b.subscriberMu.Lock()
+	if packet.Retain() {
+		b.storeRetained(packet.Packet)
+	}
+	b.queueForOfflineSessions(packet.Packet)
+	b.subscriberMu.Unlock()
+}
+
+// aliveCheck pings the primary every heartbeat interval on a persistent
+// connection and takes over once the failure detector suspects it
+func (b *Broker) aliveCheck() {
+	ticker := time.NewTicker(b.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	primary := &heartbeat{addr: b.config.PeerAddr, timeout: b.config.HeartbeatTimeout}
+	defer primary.close()
+	detector := b.config.FailureDetector
+
+	suspected := false
+	staleReported := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+
+		epoch, err := primary.ping(b.epoch.Load())
+		now := time.Now()
+		if err == nil {
+			detector.Heartbeat(now)
+		} else {
+			detector.Miss(now)
+		}
+
+		level, threshold := detector.Suspicion(now)
+		if failed := level >= threshold; failed != suspected {
+			suspected = failed
+			b.reportSuspicion(SuspicionEvent{
+				Time:      now,
+				Peer:      b.config.PeerAddr,
+				Detector:  detector.Name(),
+				Level:     level,
+				Threshold: threshold,
+				Suspected: suspected,
+			})
+		}
+
+		if err == nil {
+			// A primary with a newer epoch puts us back on standby
+			b.observeEpoch(epoch)
+
+			b.primaryAliveMu.Lock()
+			if !b.primaryAlive && !staleReported {
+				// Our PING carried our epoch, which fences the old primary
+				fmt.Printf("Old primary is reachable again at epoch %d; staying in charge at epoch %d\n", epoch, b.epoch.Load())
+				staleReported = true
+			}
+			b.primaryAliveMu.Unlock()
+		}
+		if !suspected {
+			continue
+		}
+
+		b.primaryAliveMu.Lock()
+		if b.primaryAlive {
+			epoch := b.takeOver()
+			fmt.Printf("⚠️  PRIMARY IS DOWN! Taking over with epoch %d...\n", epoch)
+			b.primaryAlive = false
+			staleReported = false
+			// Process all replicated messages
+			go b.processReplicatedMessages()
+		}
+		b.primaryAliveMu.Unlock()
+	}
+}
+
+// reportSuspicion logs a change of suspicion of the primary and passes it
+// to Config.OnSuspicion
+func (b *Broker) reportSuspicion(event SuspicionEvent) {
+	if event.Suspected {
+		fmt.Printf("⚠️  Primary suspected: %s\n", event)
+	} else {
+		fmt.Printf("✓ Primary no longer suspected: %s\n", event)
+	}
+	if b.config.OnSuspicion != nil {
+		b.config.OnSuspicion(event)
+	}
+}
+
+// processReplicatedMessages processes the messages the primary replicated
+// but never cleared, in the order the primary received them, when becoming
+// active
+func (b *Broker) processReplicatedMessages() {
+	b.replicatedMsgsMu.Lock()
+	b.takeOverSessions()
+	messages := b.replicatedMsgs.drain()
+	b.replicatedMsgsMu.Unlock()
+
+	fmt.Printf("Processing %d replicated messages...\n", len(messages))
+
+	for _, message := range messages {
+		fmt.Printf("Replaying #%d: %s -> %s\n", message.Seq, message.Topic, message.Payload)
+		// The sequence number belongs to the primary, not to our own log.
+		// A cluster shares the numbers and clears the message everywhere.
+		if b.cluster == nil {
+			message.Seq = 0
+		}
+		b.replayPublish(Packet{Packet: message})
+	}
+}
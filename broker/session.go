@@ -0,0 +1,270 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// queuedMessage is a delivery held for an offline session
+type queuedMessage struct {
+	packet     *protocol.Packet
+	qos        byte
+	enqueuedAt time.Time
+}
+
+// size is the number of bytes a queued message counts against the limit
+func (m *queuedMessage) size() int {
+	return len(m.packet.Topic) + len(m.packet.Payload)
+}
+
+// session holds the subscriptions and delivery state of a client. Sessions
+// of clients that connect with a client ID outlive the connection: while
+// offline they queue messages, which are drained when the client reconnects
+// with the same ID. Clients without an ID get a private session that ends
+// with their connection.
+type session struct {
+	clientID string  // empty for non-persistent sessions
+	client   *client // current connection, nil while offline
+
+	filters  map[string]byte             // subscribed topic filters -> granted QoS
+	lastID   uint64                      // last packet ID assigned to a delivery
+	inflight map[uint64]*inflightMessage // unacknowledged QoS 1 deliveries
+
+	queue      []*queuedMessage // messages received while offline, oldest first
+	queueBytes int
+	dropped    int // queued messages discarded because of the limits
+
+	remoteOnline bool // backup only: the client is connected to the primary
+}
+
+// Session changes a primary replicates to its backup in SESSION packets
+const (
+	sessionSubscribe   = "subscribe"
+	sessionUnsubscribe = "unsubscribe"
+	sessionOnline      = "online"
+	sessionOffline     = "offline"
+)
+
+func newSession(clientID string) *session {
+	return &session{
+		clientID: clientID,
+		filters:  make(map[string]byte),
+		inflight: make(map[uint64]*inflightMessage),
+	}
+}
+
+// persistent reports whether the session survives its connection
+func (s *session) persistent() bool {
+	return s.clientID != ""
+}
+
+// enqueue holds a message for an offline session, discarding the oldest
+// messages once the count or byte limit is exceeded
+func (s *session) enqueue(message *protocol.Packet, qos byte, config Config) {
+	queued := &queuedMessage{packet: message, qos: qos, enqueuedAt: time.Now()}
+	s.queue = append(s.queue, queued)
+	s.queueBytes += queued.size()
+
+	for len(s.queue) > 0 && (len(s.queue) > config.SessionQueueLimit || s.queueBytes > config.SessionQueueBytes) {
+		s.dropOldest()
+	}
+}
+
+// expire discards queued messages older than maxAge
+func (s *session) expire(now time.Time, maxAge time.Duration) {
+	for len(s.queue) > 0 && now.Sub(s.queue[0].enqueuedAt) > maxAge {
+		s.dropOldest()
+	}
+}
+
+func (s *session) dropOldest() {
+	s.queueBytes -= s.queue[0].size()
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.dropped++
+}
+
+// resume attaches c to the persistent session of its client ID, creating
+// the session on first use. Subscriptions made before CONNECT move into
+// the session. In-flight and queued messages are sent to the new
+// connection. The caller must hold subscriberMu.
+func (b *Broker) resume(c *client, clientID string) error {
+	s, ok := b.sessions[clientID]
+	if !ok {
+		s = newSession(clientID)
+		b.sessions[clientID] = s
+		fmt.Printf("New session for client '%s'\n", clientID)
+	} else {
+		fmt.Printf("Resuming session of client '%s' (%d queued, %d in flight, %d dropped)\n",
+			clientID, len(s.queue), len(s.inflight), s.dropped)
+	}
+
+	// The same client ID connected again: the newer connection wins
+	if s.client != nil && s.client != c {
+		old := s.client
+		fmt.Printf("Client '%s' reconnected, closing old connection %s\n", clientID, old.conn.RemoteAddr())
+		old.session = newSession("")
+		old.conn.Close()
+	}
+
+	previous := c.session
+	for filter, qos := range previous.filters {
+		b.topics.unsubscribe(filter, previous)
+		if _, ok := s.filters[filter]; !ok {
+			s.filters[filter] = qos
+			b.topics.subscribe(filter, s, qos)
+			b.replicateSession(s, sessionSubscribe, filter, qos)
+		}
+	}
+	c.session = s
+	s.client = c
+	b.replicateSession(s, sessionOnline, "", 0)
+
+	// Retransmit what the previous connection never acknowledged
+	for _, message := range s.inflight {
+		message.packet.Flags |= protocol.FlagDup
+		message.sentAt = time.Now()
+		if err := c.send(message.packet); err != nil {
+			return err
+		}
+	}
+
+	// A passive backup only mirrors the queue; the primary delivers it
+	if !b.acceptsPublish() {
+		return nil
+	}
+	return b.drain(s)
+}
+
+// drain delivers the offline queue of s in order, ageing out stale
+// messages first. The caller must hold subscriberMu.
+func (b *Broker) drain(s *session) error {
+	s.expire(time.Now(), b.config.SessionQueueAge)
+	queue := s.queue
+	s.queue = nil
+	s.queueBytes = 0
+	s.dropped = 0
+	for _, queued := range queue {
+		if err := b.deliver(s, queued.packet, queued.qos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detach ends the connection of a session. Persistent sessions keep their
+// subscriptions and start queueing; private ones are removed. The caller
+// must hold subscriberMu.
+func (b *Broker) detach(c *client) {
+	s := c.session
+	if s.client != c {
+		// Already taken over by a newer connection
+		return
+	}
+	s.client = nil
+
+	if s.persistent() {
+		fmt.Printf("Client '%s' went offline, keeping %d subscriptions\n", s.clientID, len(s.filters))
+		b.replicateSession(s, sessionOffline, "", 0)
+		return
+	}
+
+	for filter := range s.filters {
+		b.topics.unsubscribe(filter, s)
+		fmt.Printf("Subscriber removed from topic '%s': %s\n", filter, c.conn.RemoteAddr())
+	}
+	if len(s.inflight) > 0 {
+		fmt.Printf("Dropping %d unacknowledged messages for %s\n", len(s.inflight), c.conn.RemoteAddr())
+	}
+}
+
+// replicateSession tells the backup about a change of a persistent session,
+// so it can serve the session after a failover. Private sessions end with
+// their connection and are not replicated. The caller must hold
+// subscriberMu.
+func (b *Broker) replicateSession(s *session, change, filter string, qos byte) {
+	if !b.replicating() || !s.persistent() {
+		return
+	}
+	packet := &protocol.Packet{Type: protocol.SESSION, Topic: filter, Payload: []byte(change), ClientID: s.clientID}
+	packet.SetQoS(qos)
+	b.sendToBackup(packet)
+}
+
+// handleSession applies a session change replicated by the primary
+func (b *Broker) handleSession(packet Packet) {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+
+	s, ok := b.sessions[packet.ClientID]
+	if !ok {
+		s = newSession(packet.ClientID)
+		b.sessions[packet.ClientID] = s
+	}
+
+	switch change := string(packet.Payload); change {
+	case sessionSubscribe:
+		if err := validateFilter(packet.Topic); err != nil {
+			fmt.Printf("Ignoring replicated subscription '%s': %v\n", packet.Topic, err)
+			return
+		}
+		s.filters[packet.Topic] = packet.QoS()
+		b.topics.subscribe(packet.Topic, s, packet.QoS())
+	case sessionUnsubscribe:
+		if _, ok := s.filters[packet.Topic]; ok {
+			delete(s.filters, packet.Topic)
+			b.topics.unsubscribe(packet.Topic, s)
+		}
+	case sessionOnline:
+		// The primary drains its own queue for the client
+		s.remoteOnline = true
+		s.queue = nil
+		s.queueBytes = 0
+		s.dropped = 0
+	case sessionOffline:
+		s.remoteOnline = false
+	default:
+		fmt.Printf("Ignoring unknown session change '%s'\n", change)
+		return
+	}
+	fmt.Printf("Session of client '%s': %s %s\n", packet.ClientID, packet.Payload, packet.Topic)
+}
+
+// queueForOfflineSessions mirrors a message the primary processed into the
+// queues of persistent sessions that are offline on the primary, so they
+// are still delivered if the client only reconnects after a failover. The
+// caller must hold subscriberMu.
+func (b *Broker) queueForOfflineSessions(p *protocol.Packet) {
+	message := &protocol.Packet{Type: protocol.PUBLISH, Topic: p.Topic, Payload: p.Payload, Headers: p.Headers}
+	for s, qos := range b.topics.match(p.Topic) {
+		if s.persistent() && s.client == nil && !s.remoteOnline {
+			s.enqueue(message, qos, b.config)
+		}
+	}
+}
+
+// takeOverSessions makes a backup that becomes active responsible for the
+// replicated sessions: none of them is connected to the primary any more,
+// and clients already connected here get their queued messages.
+func (b *Broker) takeOverSessions() {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+
+	var failed []net.Conn
+	for _, s := range b.sessions {
+		s.remoteOnline = false
+		if s.client == nil || len(s.queue) == 0 {
+			continue
+		}
+		if err := b.drain(s); err != nil {
+			fmt.Println("Error writing to subscriber:", err)
+			failed = append(failed, s.client.conn)
+		}
+	}
+	for _, conn := range failed {
+		conn.Close()
+	}
+}
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// Markers of a snapshot in SNAPSHOT packets
+const (
+	snapshotBegin = "begin"
+	snapshotEnd   = "end"
+)
+
+// attachBackup sends a fresh replication connection a snapshot of the
+// primary's state and makes it the live replication connection. The state
+// is locked while the snapshot is written, so every change after it reaches
+// the backup through the live stream. Messages can appear in both; the
+// backup keys them by sequence number, so applying one twice is harmless.
+// Writes that take longer than Config.WriteTimeout fail, and the caller
+// drops the connection.
+func (b *Broker) attachBackup(conn net.Conn) error {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+	b.pendingReleasesMu.Lock()
+	defer b.pendingReleasesMu.Unlock()
+	b.unprocessedMu.Lock()
+	defer b.unprocessedMu.Unlock()
+	b.backupMu.Lock()
+	defer b.backupMu.Unlock()
+
+	// A backup that stops reading must not keep the state locked
+	conn.SetWriteDeadline(time.Now().Add(b.config.WriteTimeout))
+	if err := b.writeSnapshot(conn); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sent snapshot to backup: %d unprocessed messages, %d retained, %d sessions, sequence #%d\n",
+		len(b.unprocessed.messages), len(b.retained), len(b.sessions), b.lastSeq.Load())
+	b.backupConn = conn
+	b.backupHealthy = false
+	return nil
+}
+
+// writeSnapshot writes the broker's state to conn, bracketed by SNAPSHOT
+// packets. The caller must hold subscriberMu, pendingReleasesMu and
+// unprocessedMu.
+func (b *Broker) writeSnapshot(conn net.Conn) error {
+	w := bufio.NewWriter(conn)
+	write := func(p *protocol.Packet) error {
+		data, err := protocol.Encode(b.stamp(p))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	packets := []*protocol.Packet{{Type: protocol.SNAPSHOT, Payload: []byte(snapshotBegin), Seq: b.lastSeq.Load()}}
+	packets = append(packets, b.unprocessed.messages...)
+	for key := range b.pendingReleases {
+		// Keys are clientID/id, see releaseKey
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			continue
+		}
+		id, err := strconv.ParseUint(key[i+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		packets = append(packets, &protocol.Packet{Type: protocol.PUBREC, ID: id, ClientID: key[:i]})
+	}
+	for _, message := range b.retained {
+		packets = append(packets, &protocol.Packet{Type: protocol.RETAINED, Topic: message.Topic, Payload: message.Payload, Headers: message.Headers})
+	}
+	for _, s := range b.sessions {
+		for filter, qos := range s.filters {
+			packet := &protocol.Packet{Type: protocol.SESSION, Topic: filter, Payload: []byte(sessionSubscribe), ClientID: s.clientID}
+			packet.SetQoS(qos)
+			packets = append(packets, packet)
+		}
+		change := sessionOffline
+		if s.client != nil {
+			change = sessionOnline
+		}
+		packets = append(packets, &protocol.Packet{Type: protocol.SESSION, Payload: []byte(change), ClientID: s.clientID})
+	}
+	packets = append(packets, &protocol.Packet{Type: protocol.SNAPSHOT, Payload: []byte(snapshotEnd)})
+
+	for _, p := range packets {
+		if err := write(p); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// handleSnapshot starts or completes applying a snapshot from the primary.
+// At the start, the state mirrored from an earlier connection is dropped,
+// since the snapshot replaces it.
+func (b *Broker) handleSnapshot(packet Packet) {
+	switch string(packet.Payload) {
+	case snapshotBegin:
+		b.replicatedMsgsMu.Lock()
+		b.replicatedMsgs = pendingLog{}
+		b.replicatedMsgsMu.Unlock()
+
+		b.pendingReleasesMu.Lock()
+		b.pendingReleases = make(map[string]struct{})
+		b.pendingReleasesMu.Unlock()
+
+		b.subscriberMu.Lock()
+		b.retained = make(map[string]*protocol.Packet)
+		for _, s := range b.sessions {
+			s.remoteOnline = false
+			// Subscriptions of clients connected here are their own
+			if s.client != nil {
+				continue
+			}
+			for filter := range s.filters {
+				b.topics.unsubscribe(filter, s)
+				delete(s.filters, filter)
+			}
+		}
+		b.subscriberMu.Unlock()
+
+		b.advanceSeq(packet.Seq)
+		fmt.Printf("Receiving snapshot from primary at sequence #%d...\n", packet.Seq)
+	case snapshotEnd:
+		b.replicatedMsgsMu.Lock()
+		pending := len(b.replicatedMsgs.messages)
+		b.replicatedMsgsMu.Unlock()
+		fmt.Printf("✓ Caught up with primary (%d unprocessed messages)\n", pending)
+		reply(packet, b.stamp(&protocol.Packet{Type: protocol.SNAPSHOT, Payload: []byte(snapshotEnd)}))
+	}
+}
+
+// handleRetained stores a retained message from the primary's snapshot
+func (b *Broker) handleRetained(packet Packet) {
+	b.subscriberMu.Lock()
+	defer b.subscriberMu.Unlock()
+
+	if err := validateTopic(packet.Topic); err != nil {
+		return
+	}
+	b.retained[packet.Topic] = &protocol.Packet{
+		Type:    protocol.PUBLISH,
+		Flags:   protocol.FlagRetain,
+		Topic:   packet.Topic,
+		Payload: packet.Payload,
+		Headers: packet.Headers,
+	}
+}
@@ -0,0 +1,178 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// topicSeparator splits a topic into levels
+	topicSeparator = "/"
+	// singleLevelWildcard matches exactly one topic level
+	singleLevelWildcard = "+"
+	// multiLevelWildcard matches any number of trailing topic levels,
+	// including the parent level itself
+	multiLevelWildcard = "#"
+)
+
+var (
+	errEmptyTopic       = errors.New("topic must not be empty")
+	errWildcardInTopic  = errors.New("wildcards are not allowed in a published topic")
+	errInvalidWildcard  = errors.New("wildcards must occupy a whole topic level")
+	errMultiLevelNotEnd = errors.New("'#' must be the last level of a topic filter")
+)
+
+// validateTopic checks a topic name used in PUBLISH
+func validateTopic(topic string) error {
+	if topic == "" {
+		return errEmptyTopic
+	}
+	if strings.ContainsAny(topic, singleLevelWildcard+multiLevelWildcard) {
+		return errWildcardInTopic
+	}
+	return nil
+}
+
+// validateFilter checks a topic filter used in SUBSCRIBE
+func validateFilter(filter string) error {
+	if filter == "" {
+		return errEmptyTopic
+	}
+	levels := strings.Split(filter, topicSeparator)
+	for i, level := range levels {
+		switch {
+		case level == multiLevelWildcard:
+			if i != len(levels)-1 {
+				return errMultiLevelNotEnd
+			}
+		case level == singleLevelWildcard:
+		case strings.ContainsAny(level, singleLevelWildcard+multiLevelWildcard):
+			return errInvalidWildcard
+		}
+	}
+	return nil
+}
+
+// matchTopic reports whether a topic name matches a topic filter
+func matchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, topicSeparator)
+	topicLevels := strings.Split(topic, topicSeparator)
+
+	for i, level := range filterLevels {
+		if level == multiLevelWildcard {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != singleLevelWildcard && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// topicNode is one level of the topic trie
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[*session]byte // subscriber -> granted QoS
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[*session]byte),
+	}
+}
+
+func (n *topicNode) empty() bool {
+	return len(n.children) == 0 && len(n.subscribers) == 0
+}
+
+// topicTree indexes subscriptions by topic filter, one trie level per topic
+// level, so a publish only visits the branches that can match it.
+type topicTree struct {
+	root *topicNode
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{root: newTopicNode()}
+}
+
+// subscribe adds s under filter with the granted QoS. Subscribing again
+// replaces the QoS.
+func (t *topicTree) subscribe(filter string, s *session, qos byte) {
+	node := t.root
+	for _, level := range strings.Split(filter, topicSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subscribers[s] = qos
+}
+
+// unsubscribe removes s from filter and prunes empty branches.
+// It reports whether the subscription existed.
+func (t *topicTree) unsubscribe(filter string, s *session) bool {
+	levels := strings.Split(filter, topicSeparator)
+	path := make([]*topicNode, 0, len(levels)+1)
+	path = append(path, t.root)
+
+	node := t.root
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return false
+		}
+		node = child
+		path = append(path, node)
+	}
+
+	if _, ok := node.subscribers[s]; !ok {
+		return false
+	}
+	delete(node.subscribers, s)
+
+	for i := len(levels) - 1; i >= 0 && path[i+1].empty(); i-- {
+		delete(path[i].children, levels[i])
+	}
+	return true
+}
+
+// match returns every subscriber with a filter matching topic. A subscriber
+// matched by several filters is returned once, with the highest granted QoS.
+func (t *topicTree) match(topic string) map[*session]byte {
+	seen := make(map[*session]byte)
+	t.root.match(strings.Split(topic, topicSeparator), seen)
+	return seen
+}
+
+func (n *topicNode) match(levels []string, seen map[*session]byte) {
+	// '#' also matches the parent level: "a/#" matches "a"
+	if child, ok := n.children[multiLevelWildcard]; ok {
+		child.collect(seen)
+	}
+
+	if len(levels) == 0 {
+		n.collect(seen)
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], seen)
+	}
+	if child, ok := n.children[singleLevelWildcard]; ok {
+		child.match(levels[1:], seen)
+	}
+}
+
+func (n *topicNode) collect(seen map[*session]byte) {
+	for s, qos := range n.subscribers {
+		if granted, ok := seen[s]; !ok || qos > granted {
+			seen[s] = qos
+		}
+	}
+}
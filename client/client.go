@@ -0,0 +1,170 @@
+// Package client is the Go client of the broker. It hides the details every
+// publisher and subscriber otherwise repeats: connecting, waiting for ACKs,
+// failing over between a primary and its backup (or the members of a
+// cluster), resending recent messages after a failover and reconnecting
+// subscriptions.
+//
+//	c, err := client.New(client.Options{Brokers: []string{"localhost:8080", "localhost:8081"}})
+//	...
+//	err = c.Publish(ctx, "news", []byte("hello"))
+//	...
+//	err = c.Subscribe(ctx, "news", func(m client.Message) {
+//		fmt.Printf("%s: %s\n", m.Topic, m.Payload)
+//	})
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// Defaults for zero Options fields
+const (
+	DefaultAckTimeout        = 500 * time.Millisecond
+	DefaultDialTimeout       = 500 * time.Millisecond
+	DefaultResendBuffer      = 5
+	DefaultReconnectInterval = 2 * time.Second
+)
+
+// maxRedirects bounds how often a publish follows a broker's redirect
+const maxRedirects = 3
+
+var (
+	// ErrClosed is returned by a Client after Close.
+	ErrClosed = errors.New("client: closed")
+	// ErrNoBrokers is returned by New when Options.Brokers is empty.
+	ErrNoBrokers = errors.New("client: no broker addresses")
+)
+
+// Options configures a client
+type Options struct {
+	// Brokers are the addresses of the brokers, in order of preference:
+	// the primary first, then its backup, or the members of a cluster.
+	Brokers []string
+	// ClientID names the persistent session of the subscriptions. Empty
+	// subscribes without a session.
+	ClientID string
+	// QoS is the level subscriptions are requested with: AtMostOnce or
+	// AtLeastOnce.
+	QoS byte
+
+	// AckTimeout is how long a broker may take to acknowledge a publish
+	// before the client fails over. Zero selects DefaultAckTimeout.
+	AckTimeout time.Duration
+	// DialTimeout bounds connecting to a broker. Zero selects
+	// DefaultDialTimeout.
+	DialTimeout time.Duration
+	// ResendBuffer is how many acknowledged messages are published again
+	// after a failover, since a primary may acknowledge a message before
+	// its backup has it. Zero selects DefaultResendBuffer, a negative
+	// value disables resending.
+	ResendBuffer int
+	// ReconnectInterval is the pause before a subscription reconnects, and
+	// before a publish tries the brokers again once all of them failed.
+	// Zero selects DefaultReconnectInterval.
+	ReconnectInterval time.Duration
+
+	// Logf, if set, receives a line for every connection change and
+	// failover.
+	Logf func(format string, args ...any)
+}
+
+// Client publishes and subscribes through a set of brokers. It is safe for
+// concurrent use.
+type Client struct {
+	opts Options
+
+	// Publishing: the connection in use and how to replace it
+	publishMu sync.Mutex
+	conn      *connection        // nil until connected and after a failure
+	brokers   []string           // Options.Brokers and learned cluster leaders
+	current   int                // index of the broker publishes go to
+	switched  bool               // whether current changed since the last connection
+	recent    []*protocol.Packet // last acknowledged publishes, oldest first
+
+	// highestEpoch is the newest leadership epoch seen on any connection.
+	// Deliveries from an older epoch come from a broker that was replaced.
+	highestEpoch atomic.Uint64
+
+	wg        sync.WaitGroup
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns a client for the given brokers. It does not connect until
+// the first Publish or Subscribe.
+func New(opts Options) (*Client, error) {
+	if len(opts.Brokers) == 0 {
+		return nil, ErrNoBrokers
+	}
+	if opts.QoS > protocol.AtLeastOnce {
+		return nil, fmt.Errorf("client: unsupported subscription QoS %d", opts.QoS)
+	}
+	if opts.AckTimeout == 0 {
+		opts.AckTimeout = DefaultAckTimeout
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.ResendBuffer == 0 {
+		opts.ResendBuffer = DefaultResendBuffer
+	}
+	if opts.ReconnectInterval == 0 {
+		opts.ReconnectInterval = DefaultReconnectInterval
+	}
+
+	return &Client{
+		opts:    opts,
+		brokers: append([]string(nil), opts.Brokers...),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Close ends all subscriptions and the publishing connection and waits for
+// them to close. Publish and Subscribe fail with ErrClosed afterwards.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.publishMu.Lock()
+		if c.conn != nil {
+			c.conn.close(ErrClosed)
+			c.conn = nil
+		}
+		c.publishMu.Unlock()
+	})
+	c.wg.Wait()
+	return nil
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) logf(format string, args ...any) {
+	if c.opts.Logf != nil {
+		c.opts.Logf(format, args...)
+	}
+}
+
+// fresh records the epoch of a packet and reports whether it is current
+func (c *Client) fresh(epoch uint64) bool {
+	for {
+		highest := c.highestEpoch.Load()
+		if epoch < highest {
+			return false
+		}
+		if epoch == highest || c.highestEpoch.CompareAndSwap(highest, epoch) {
+			return true
+		}
+	}
+}
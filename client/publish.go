@@ -0,0 +1,349 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// redirectError is returned when a cluster member that is not leading
+// names the leader
+type redirectError struct {
+	addr string
+}
+
+func (e *redirectError) Error() string {
+	return "redirected to " + e.addr
+}
+
+// errAckTimeout is returned when a broker did not acknowledge a publish
+// within AckTimeout
+var errAckTimeout = errors.New("no ACK in time")
+
+// connection is the persistent connection publishes are sent on. Each
+// PUBLISH carries a packet ID, which tells the broker to keep the
+// connection open, and the broker's ACK echoes it. So publishes are
+// pipelined: many may be waiting for their ACK at once.
+type connection struct {
+	addr string
+	conn net.Conn
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	lastID  uint64
+	pending map[uint64]chan error // packet ID -> waiting publish
+	err     error                 // why the connection ended, nil while open
+}
+
+// Publish sends a message and returns once a broker acknowledged it.
+// Concurrent calls share one connection and wait for their ACKs in
+// parallel; messages published by one goroutine arrive in order.
+//
+// If the broker in use does not acknowledge within AckTimeout, the client
+// fails over to the next broker and first resends the messages it published
+// last, which the failed broker may not have passed on. It keeps trying the
+// brokers in turn, pausing ReconnectInterval after each round, until ctx is
+// done. Messages are delivered at least once: a resent message may be
+// delivered twice.
+func (c *Client) Publish(ctx context.Context, topic string, payload []byte) error {
+	return c.PublishWithHeaders(ctx, topic, payload, nil)
+}
+
+// PublishWithHeaders is Publish for a message with headers, such as a
+// content type or a trace ID, which subscribers receive in Message.Headers
+func (c *Client) PublishWithHeaders(ctx context.Context, topic string, payload []byte, headers map[string]string) error {
+	if c.closed() {
+		return ErrClosed
+	}
+	packet := &protocol.Packet{Type: protocol.PUBLISH, Topic: topic, Payload: payload, Headers: headers}
+
+	redirects := 0
+	for {
+		conn, err := c.connection(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = c.publishOn(ctx, conn, packet)
+		if err == nil {
+			c.remember(packet)
+			return nil
+		}
+		if ctx.Err() != nil {
+			// Our deadline is not the connection's fault
+			return fmt.Errorf("client: publish failed: %w", err)
+		}
+
+		var redirect *redirectError
+		if errors.As(err, &redirect) && redirects < maxRedirects {
+			redirects++
+			c.follow(conn, redirect.addr)
+			continue
+		}
+		c.drop(conn, err)
+	}
+}
+
+// connection returns the connection to publish on, connecting to the next
+// broker that accepts it if there is none
+func (c *Client) connection(ctx context.Context) (*connection, error) {
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+
+	var lastErr error
+	for failures := 0; c.conn == nil; failures++ {
+		if failures > 0 && failures%len(c.brokers) == 0 {
+			// Every broker failed. A backup only serves publishers once it
+			// noticed its primary is down, so give it time.
+			if err := c.wait(ctx, c.opts.ReconnectInterval); err != nil {
+				return nil, fmt.Errorf("client: publish failed: %w (last error: %v)", err, lastErr)
+			}
+		}
+		if c.closed() {
+			return nil, ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("client: publish failed: %w (last error: %v)", err, lastErr)
+		}
+
+		addr := c.brokers[c.current]
+		conn, err := c.connect(ctx, addr)
+		if err == nil && c.switched {
+			if err = c.resend(ctx, conn); err != nil {
+				conn.close(err)
+			}
+		}
+		if err != nil {
+			lastErr = err
+			var redirect *redirectError
+			if errors.As(err, &redirect) {
+				c.moveTo(redirect.addr)
+			} else {
+				c.failover(addr, err)
+			}
+			continue
+		}
+		c.switched = false
+		c.conn = conn
+	}
+	return c.conn, nil
+}
+
+// connect dials a broker and starts reading its ACKs
+func (c *Client) connect(ctx context.Context, addr string) (*connection, error) {
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	pc := &connection{addr: addr, conn: conn, pending: make(map[uint64]chan error)}
+	go c.readAcks(pc)
+	return pc, nil
+}
+
+// readAcks hands the ACKs of a connection to the waiting publishes until
+// the connection ends
+func (c *Client) readAcks(pc *connection) {
+	decoder := protocol.NewDecoder(pc.conn)
+	for {
+		response, err := decoder.Decode()
+		if err != nil {
+			pc.close(fmt.Errorf("connection to %s lost: %w", pc.addr, err))
+			return
+		}
+		switch {
+		case response.Type == protocol.ACK:
+			c.fresh(response.Epoch)
+			pc.ack(response.ID)
+		case response.Type == protocol.DISCONNECT && response.Topic != "":
+			// A cluster member that is not leading names the leader
+			pc.close(&redirectError{addr: response.Topic})
+			return
+		}
+	}
+}
+
+// publishOn sends a packet on a connection and waits for its ACK
+func (c *Client) publishOn(ctx context.Context, pc *connection, packet *protocol.Packet) error {
+	acked, err := pc.send(packet)
+	if err != nil {
+		return err
+	}
+	return c.await(ctx, pc, acked)
+}
+
+// await waits for an ACK requested with send
+func (c *Client) await(ctx context.Context, pc *connection, acked <-chan error) error {
+	timer := time.NewTimer(c.opts.AckTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-acked:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w from %s", errAckTimeout, pc.addr)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// resend publishes the remembered messages again after a failover. They are
+// sent back to back and their ACKs awaited afterwards.
+func (c *Client) resend(ctx context.Context, pc *connection) error {
+	if len(c.recent) == 0 {
+		return nil
+	}
+	c.logf("Resending the last %d messages to %s", len(c.recent), pc.addr)
+
+	var acks []<-chan error
+	for _, packet := range c.recent {
+		dup := *packet
+		dup.Flags |= protocol.FlagDup
+		acked, err := pc.send(&dup)
+		if err != nil {
+			return err
+		}
+		acks = append(acks, acked)
+	}
+	for _, acked := range acks {
+		if err := c.await(ctx, pc, acked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remember keeps an acknowledged packet for resending after a failover
+func (c *Client) remember(packet *protocol.Packet) {
+	if c.opts.ResendBuffer < 0 {
+		return
+	}
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+	c.recent = append(c.recent, packet)
+	if len(c.recent) > c.opts.ResendBuffer {
+		c.recent = c.recent[1:]
+	}
+}
+
+// drop closes a failed connection and, unless another publish already did,
+// fails over to the next broker
+func (c *Client) drop(pc *connection, err error) {
+	pc.close(err)
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+	if c.conn == pc {
+		c.conn = nil
+		c.failover(pc.addr, err)
+	}
+}
+
+// follow closes a connection to a cluster member that redirected us and
+// moves publishing to the leader it named
+func (c *Client) follow(pc *connection, addr string) {
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+	if c.conn == pc {
+		c.conn = nil
+		c.moveTo(addr)
+	}
+}
+
+// failover moves publishing to the next broker. The caller must hold
+// publishMu.
+func (c *Client) failover(addr string, err error) {
+	c.current = (c.current + 1) % len(c.brokers)
+	c.switched = true
+	c.logf("Publishing to %s failed (%v), switching to %s", addr, err, c.brokers[c.current])
+}
+
+// moveTo moves publishing to the broker a redirect named, remembering its
+// address if it is new. The caller must hold publishMu.
+func (c *Client) moveTo(addr string) {
+	c.logf("Redirected to the cluster leader at %s", addr)
+	for i, broker := range c.brokers {
+		if broker == addr {
+			c.current = i
+			return
+		}
+	}
+	c.brokers = append(c.brokers, addr)
+	c.current = len(c.brokers) - 1
+}
+
+// send writes a PUBLISH with the next packet ID and returns the channel its
+// ACK, or the end of the connection, is reported on
+func (pc *connection) send(packet *protocol.Packet) (<-chan error, error) {
+	acked := make(chan error, 1)
+
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return nil, pc.err
+	}
+	pc.lastID++
+	numbered := *packet
+	numbered.ID = pc.lastID
+	pc.pending[numbered.ID] = acked
+	pc.mu.Unlock()
+
+	pc.writeMu.Lock()
+	err := protocol.Write(pc.conn, &numbered)
+	pc.writeMu.Unlock()
+	if err != nil {
+		pc.close(err)
+	}
+	return acked, nil
+}
+
+// ack reports the ACK of a packet ID to its publish
+func (pc *connection) ack(id uint64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if acked, ok := pc.pending[id]; ok {
+		acked <- nil
+		delete(pc.pending, id)
+	}
+}
+
+// close ends the connection and fails the publishes still waiting on it
+func (pc *connection) close(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err != nil {
+		return
+	}
+	pc.err = err
+	pc.conn.Close()
+	for id, acked := range pc.pending {
+		acked <- err
+		delete(pc.pending, id)
+	}
+}
+
+// dial connects to a broker within DialTimeout
+func (c *Client) dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: c.opts.DialTimeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// wait pauses for d, or returns an error if ctx is done or the client is
+// closed first
+func (c *Client) wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	}
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go-broker/protocol"
+)
+
+// Message is a message delivered to a subscription
+type Message struct {
+	Topic   string
+	Payload []byte
+	// Headers are the key/value pairs the message was published with, nil
+	// if it has none.
+	Headers map[string]string
+	// Retained is set on the retained message replayed on subscribing.
+	Retained bool
+	// Dup is set on a QoS 1 delivery the broker retransmitted.
+	Dup bool
+}
+
+// Handler is called with the messages of a subscription, one at a time
+type Handler func(Message)
+
+// Subscribe subscribes to a topic filter and calls handler for every
+// message published to it.
+//
+// The subscription is made on every broker, since only the one in charge
+// delivers: messages keep arriving across a failover, and deliveries from
+// a broker that was replaced are dropped. Connections that drop are
+// reestablished every ReconnectInterval. Subscribe returns right away; the
+// subscription lasts until ctx is done or the client is closed.
+func (c *Client) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	if c.closed() {
+		return ErrClosed
+	}
+	if topic == "" {
+		return errors.New("client: empty topic filter")
+	}
+
+	var mu sync.Mutex
+	deliver := func(m Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		handler(m)
+	}
+	for _, addr := range c.opts.Brokers {
+		c.wg.Add(1)
+		go c.subscription(ctx, addr, topic, deliver)
+	}
+	return nil
+}
+
+// subscription keeps a subscription on one broker until ctx is done or the
+// client is closed
+func (c *Client) subscription(ctx context.Context, addr, topic string, deliver Handler) {
+	defer c.wg.Done()
+
+	for {
+		if err := c.subscribeOnce(ctx, addr, topic, deliver); err != nil && ctx.Err() == nil && !c.closed() {
+			c.logf("Subscription to '%s' on %s lost: %v", topic, addr, err)
+		}
+		// A broker that hands over to another one redirects us, but we
+		// are subscribed to every broker already and stay as a standby
+		if c.wait(ctx, c.opts.ReconnectInterval) != nil {
+			return
+		}
+	}
+}
+
+// subscribeOnce runs one subscribed connection to a broker
+func (c *Client) subscribeOnce(ctx context.Context, addr, topic string, deliver Handler) error {
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock the read below when the subscription ends
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.done:
+		case <-stop:
+		}
+		conn.Close()
+	}()
+
+	// Resume the session before subscribing
+	if c.opts.ClientID != "" {
+		if err := protocol.Write(conn, &protocol.Packet{Type: protocol.CONNECT, ClientID: c.opts.ClientID}); err != nil {
+			return err
+		}
+	}
+	subscribe := &protocol.Packet{Type: protocol.SUBSCRIBE, Topic: topic}
+	subscribe.SetQoS(c.opts.QoS)
+	if err := protocol.Write(conn, subscribe); err != nil {
+		return err
+	}
+	c.logf("Subscribed to '%s' on %s", topic, addr)
+
+	decoder := protocol.NewDecoder(conn)
+	for {
+		message, err := decoder.Decode()
+		if err != nil {
+			return err
+		}
+		if message.Type == protocol.DISCONNECT && message.Topic != "" {
+			return fmt.Errorf("redirected to %s", message.Topic)
+		}
+		if message.Type != protocol.PUBLISH {
+			continue
+		}
+
+		if c.fresh(message.Epoch) {
+			deliver(Message{
+				Topic:    message.Topic,
+				Payload:  message.Payload,
+				Headers:  message.Headers,
+				Retained: message.Retain(),
+				Dup:      message.Dup(),
+			})
+		}
+
+		// Acknowledge QoS 1 deliveries so the broker stops retransmitting
+		if message.QoS() >= protocol.AtLeastOnce {
+			if err := protocol.Write(conn, &protocol.Packet{Type: protocol.PUBACK, ID: message.ID}); err != nil {
+				return err
+			}
+		}
+	}
+}
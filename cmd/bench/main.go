@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-broker/broker"
+	"go-broker/protocol"
+)
+
+// The broker runs in a child process, so its CPU time is measured apart
+// from the benchmark's and each side needs only one file descriptor per
+// connection. The child prints its address, then answers every "cpu" line
+// on stdin with the CPU time it used so far.
+
+func main() {
+	serve := flag.Bool("serve", false, "run the broker under test (used internally)")
+	conns := flag.Int("conns", 10000, "idle connections to open")
+	idle := flag.Duration("idle", 5*time.Second, "how long CPU usage is measured while idle")
+	pings := flag.Int("pings", 5000, "PING round trips to time")
+	workers := flag.Int("workers", 1, "connections pinging at the same time")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run ./cmd/bench [flags]")
+		fmt.Println("  Measures the broker's CPU usage while idle and its PING latency with many open connections")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *serve {
+		runBroker()
+		return
+	}
+
+	b, err := startBroker()
+	if err != nil {
+		fmt.Println("Error starting broker:", err)
+		return
+	}
+	defer b.stop()
+	fmt.Println("Broker under test at", b.addr)
+
+	fmt.Printf("Measuring CPU for %s with no connections...\n", *idle)
+	fmt.Printf("  idle CPU: %.1f%%\n", b.cpuPercent(*idle))
+
+	fmt.Printf("Opening %d connections...\n", *conns)
+	clients, err := dialAll(b.addr, *conns)
+	defer func() {
+		for _, conn := range clients {
+			conn.Close()
+		}
+	}()
+	if err != nil {
+		fmt.Printf("Error after %d connections: %v\n", len(clients), err)
+		return
+	}
+	// Let the broker register them all
+	time.Sleep(time.Second)
+
+	fmt.Printf("Measuring CPU for %s with %d idle connections...\n", *idle, len(clients))
+	fmt.Printf("  idle CPU: %.1f%%\n", b.cpuPercent(*idle))
+
+	fmt.Printf("Timing %d PINGs on random connections (%d at a time)...\n", *pings, *workers)
+	latencies, err := pingAll(clients, *pings, *workers)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("  p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+}
+
+// runBroker is the child process: a standalone broker with its output
+// discarded
+func runBroker() {
+	out := os.Stdout
+	devNull, err := os.Open(os.DevNull)
+	if err == nil {
+		os.Stdout = devNull
+	}
+
+	b, err := broker.New(broker.Config{Addr: "127.0.0.1:0", Role: broker.Standalone})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	b.Start()
+	fmt.Fprintln(out, b.Addr())
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if scanner.Text() == "cpu" {
+			fmt.Fprintln(out, int64(cpuTime()))
+		}
+	}
+	b.Close()
+}
+
+// brokerProcess is the child process running the broker under test
+type brokerProcess struct {
+	cmd    *exec.Cmd
+	addr   string
+	input  *bufio.Writer
+	output *bufio.Scanner
+}
+
+func startBroker() (*brokerProcess, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(self, "-serve")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	b := &brokerProcess{cmd: cmd, input: bufio.NewWriter(stdin), output: bufio.NewScanner(stdout)}
+	if !b.output.Scan() {
+		b.stop()
+		return nil, fmt.Errorf("broker exited before listening")
+	}
+	b.addr = b.output.Text()
+	return b, nil
+}
+
+// cpuTime asks the broker for the CPU time it used so far
+func (b *brokerProcess) cpuTime() time.Duration {
+	b.input.WriteString("cpu\n")
+	b.input.Flush()
+	if !b.output.Scan() {
+		return 0
+	}
+	ns, _ := strconv.ParseInt(strings.TrimSpace(b.output.Text()), 10, 64)
+	return time.Duration(ns)
+}
+
+// cpuPercent measures the share of one core the broker uses during d
+func (b *brokerProcess) cpuPercent(d time.Duration) float64 {
+	before := b.cpuTime()
+	start := time.Now()
+	time.Sleep(d)
+	used := b.cpuTime() - before
+	return 100 * float64(used) / float64(time.Since(start))
+}
+
+func (b *brokerProcess) stop() {
+	b.cmd.Process.Kill()
+	b.cmd.Wait()
+}
+
+// dialAll opens n connections, a few hundred at a time
+func dialAll(addr string, n int) ([]net.Conn, error) {
+	conns := make([]net.Conn, 0, n)
+	var mu sync.Mutex
+	var firstErr error
+	batch := make(chan struct{}, 200)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		batch <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-batch }()
+			conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}()
+	}
+	wg.Wait()
+	return conns, firstErr
+}
+
+// pingAll times count PING/PONG round trips on random connections, with
+// workers connections pinging at once
+func pingAll(conns []net.Conn, count, workers int) ([]time.Duration, error) {
+	if workers > len(conns) {
+		workers = len(conns)
+	}
+	latencies := make([]time.Duration, 0, count)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Every worker pings its own share of the connections
+			decoders := make(map[net.Conn]*protocol.Decoder)
+			for i := w; i < count; i += workers {
+				conn := conns[w+workers*rand.Intn(len(conns)/workers)]
+				if decoders[conn] == nil {
+					decoders[conn] = protocol.NewDecoder(conn)
+				}
+				latency, err := ping(conn, decoders[conn], uint64(i+1))
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				latencies = append(latencies, latency)
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	return latencies, firstErr
+}
+
+// ping sends one PING and waits for its PONG
+func ping(conn net.Conn, decoder *protocol.Decoder, id uint64) (time.Duration, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if err := protocol.Write(conn, &protocol.Packet{Type: protocol.PING, ID: id}); err != nil {
+		return 0, err
+	}
+	for {
+		response, err := decoder.Decode()
+		if err != nil {
+			return 0, err
+		}
+		if response.Type == protocol.PONG && response.ID == id {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
@@ -1,39 +1,84 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"time"
+
+	"go-broker/protocol"
 )
 
+// maxRedirects bounds how often a publish follows a broker's redirect
+const maxRedirects = 3
+
 type Message struct {
 	topic   string
 	payload string
 }
 
+// headerFlag collects the -H key=value flags
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("header %q is not key=value", value)
+	}
+	h[key] = val
+	return nil
+}
+
 func main() {
-	if len(os.Args) < 5 {
-		fmt.Println("Usage: go run cmd/publisher/main.go <topic> <message> <primary-host:port> <backup-host:port>")
+	retain := flag.Bool("retain", false, "store the message as the topic's retained message (an empty message clears it)")
+	qos := flag.Uint("qos", 0, "0 waits for ACK, 2 publishes exactly once with PUBREC/PUBREL/PUBCOMP")
+	clientID := flag.String("client-id", fmt.Sprintf("publisher-%d-%d", os.Getpid(), time.Now().UnixNano()), "client ID scoping QoS 2 packet IDs")
+	headers := headerFlag{}
+	flag.Var(headers, "H", "header `key=value` sent with the message, may be repeated")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run cmd/publisher/main.go [flags] <topic> <message> <primary-host:port> <backup-host:port>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		flag.Usage()
 		return
 	}
 
-	topic := os.Args[1]
-	message := os.Args[2]
-	primaryAddr := os.Args[3]
-	backupAddr := os.Args[4]
+	topic := flag.Arg(0)
+	message := flag.Arg(1)
+	primaryAddr := flag.Arg(2)
+	backupAddr := flag.Arg(3)
+
+	var flags byte
+	if *retain {
+		flags |= protocol.FlagRetain
+	}
+
+	if *qos == uint(protocol.ExactlyOnce) {
+		publishPacket := &protocol.Packet{Type: protocol.PUBLISH, Flags: flags, Topic: topic, Payload: []byte(message), Headers: headers, ID: 1, ClientID: *clientID}
+		publishPacket.SetQoS(protocol.ExactlyOnce)
+		publishExactlyOnce(publishPacket, primaryAddr, backupAddr)
+		return
+	}
 
 	// Send message to Primary
-	success := sendMessageWithAck(topic, message, primaryAddr, true)
+	success := sendMessageWithAck(topic, message, flags, headers, primaryAddr, true, 0)
 
 	if !success {
 		fmt.Println("Primary failed, switching to backup...")
-		sendMessageWithAck(topic, message, backupAddr, false)
+		sendMessageWithAck(topic, message, flags, headers, backupAddr, false, 0)
 	}
 }
 
-func sendMessageWithAck(topic, message, brokerAddr string, waitForAck bool) bool {
+func sendMessageWithAck(topic, message string, flags byte, headers map[string]string, brokerAddr string, waitForAck bool, redirects int) bool {
 	// Connect to the broker
 	conn, err := net.Dial("tcp", brokerAddr)
 	if err != nil {
@@ -44,9 +89,9 @@ func sendMessageWithAck(topic, message, brokerAddr string, waitForAck bool) bool
 
 	fmt.Printf("Connected to broker at %s. Publishing to topic: %s\n", brokerAddr, topic)
 
-	// Send PUBLISH packet: PUBLISH|TOPIC|MESSAGE
-	publishPacket := fmt.Sprintf("PUBLISH|%s|%s\n", topic, message)
-	_, err = conn.Write([]byte(publishPacket))
+	// Send PUBLISH packet
+	publishPacket := &protocol.Packet{Type: protocol.PUBLISH, Flags: flags, Topic: topic, Payload: []byte(message), Headers: headers}
+	err = protocol.Write(conn, publishPacket)
 	if err != nil {
 		fmt.Println("Error sending message:", err)
 		return false
@@ -59,19 +104,99 @@ func sendMessageWithAck(topic, message, brokerAddr string, waitForAck bool) bool
 
 	// Wait for ACK with 500ms timeout
 	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
+	response, err := protocol.NewDecoder(conn).Decode()
 
 	if err != nil {
 		fmt.Println("Timeout waiting for ACK from primary")
 		return false
 	}
 
-	if response == "ACK\n" {
-		fmt.Printf("Message published and acknowledged: %s\n", message)
+	if response.Type == protocol.ACK {
+		fmt.Printf("Message published and acknowledged: %s (epoch %d)\n", message, response.Epoch)
 		return true
 	}
 
+	// A cluster member that is not leading names the leader
+	if response.Type == protocol.DISCONNECT && response.Topic != "" && redirects < maxRedirects {
+		fmt.Println("Redirected to the cluster leader at", response.Topic)
+		return sendMessageWithAck(topic, message, flags, headers, response.Topic, waitForAck, redirects+1)
+	}
+
 	fmt.Println("No ACK received")
 	return false
 }
+
+// publishExactlyOnce runs the QoS 2 exchange with the primary and, if it
+// fails, finishes it with the backup. The backup deduplicates the resend
+// using the packet ID replicated by the primary.
+func publishExactlyOnce(publishPacket *protocol.Packet, primaryAddr, backupAddr string) bool {
+	recorded := false
+	if sendExactlyOnce(publishPacket, primaryAddr, &recorded) {
+		return true
+	}
+
+	fmt.Println("Primary failed, switching to backup...")
+	publishPacket.Flags |= protocol.FlagDup
+
+	// The backup only serves publishers once it noticed the primary is down
+	for attempt := 0; attempt < 5; attempt++ {
+		if sendExactlyOnce(publishPacket, backupAddr, &recorded) {
+			return true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return false
+}
+
+// sendExactlyOnce sends PUBLISH and PUBREL to one broker. Once a broker has
+// answered PUBREC, recorded is set and only PUBREL may be sent again:
+// resending the PUBLISH after its release could deliver it twice.
+func sendExactlyOnce(publishPacket *protocol.Packet, brokerAddr string, recorded *bool) bool {
+	conn, err := net.Dial("tcp", brokerAddr)
+	if err != nil {
+		fmt.Println("Error connecting to broker:", err)
+		return false
+	}
+	defer conn.Close()
+
+	decoder := protocol.NewDecoder(conn)
+
+	if !*recorded {
+		if err := protocol.Write(conn, publishPacket); err != nil {
+			fmt.Println("Error sending message:", err)
+			return false
+		}
+		if !awaitReply(conn, decoder, protocol.PUBREC, publishPacket.ID) {
+			fmt.Println("Timeout waiting for PUBREC")
+			return false
+		}
+		*recorded = true
+	}
+
+	release := &protocol.Packet{Type: protocol.PUBREL, ID: publishPacket.ID, ClientID: publishPacket.ClientID}
+	if err := protocol.Write(conn, release); err != nil {
+		fmt.Println("Error sending PUBREL:", err)
+		return false
+	}
+	if !awaitReply(conn, decoder, protocol.PUBCOMP, publishPacket.ID) {
+		fmt.Println("Timeout waiting for PUBCOMP")
+		return false
+	}
+
+	fmt.Printf("Message published exactly once: %s\n", publishPacket.Payload)
+	return true
+}
+
+// awaitReply waits up to 500ms for a reply of the given type and packet ID
+func awaitReply(conn net.Conn, decoder *protocol.Decoder, replyType protocol.PacketType, id uint64) bool {
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		response, err := decoder.Decode()
+		if err != nil {
+			return false
+		}
+		if response.Type == replyType && response.ID == id {
+			return true
+		}
+	}
+}
@@ -2,68 +2,294 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
+	"maps"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-broker/protocol"
 )
 
-func subscribeToBroker(topic, brokerAddr, brokerName string, wg *sync.WaitGroup) {
+// highestEpoch is the newest leadership epoch seen on any broker connection.
+// Deliveries from an older epoch come from a broker that was replaced.
+var highestEpoch atomic.Uint64
+
+// fresh records the epoch of a delivery and reports whether it is current
+func fresh(epoch uint64) bool {
+	for {
+		highest := highestEpoch.Load()
+		if epoch < highest {
+			return false
+		}
+		if epoch == highest || highestEpoch.CompareAndSwap(highest, epoch) {
+			return true
+		}
+	}
+}
+
+// subscriptions is the current topic set, changed by "sub" and "unsub"
+// and sent again whenever a broker connection is reestablished
+type subscriptions struct {
+	mu     sync.Mutex
+	topics []string
+}
+
+// list returns the topics in the order they were subscribed
+func (s *subscriptions) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.topics)
+}
+
+// apply records a SUBSCRIBE or UNSUBSCRIBE
+func (s *subscriptions) apply(packet *protocol.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(s.topics, packet.Topic)
+	switch {
+	case packet.Type == protocol.SUBSCRIBE && i < 0:
+		s.topics = append(s.topics, packet.Topic)
+	case packet.Type == protocol.UNSUBSCRIBE && i >= 0:
+		s.topics = slices.Delete(s.topics, i, i+1)
+	}
+}
+
+func subscribeToBroker(connect *protocol.Packet, subs *subscriptions, qos byte, brokerAddr, brokerName string, commands <-chan *protocol.Packet, wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	// Keep a subscription on this broker even across restarts. A broker
+	// that hands over to another one redirects us; we already subscribe
+	// to every broker we were given, so we stay here as a standby.
+	for {
+		if redirect := subscribeOnce(connect, subs, qos, brokerAddr, brokerName, commands); redirect != "" {
+			fmt.Printf("[%s] Broker redirected us to %s, resubscribing here as standby\n", brokerName, redirect)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// subscribeOnce runs one connection to a broker. It returns the address
+// the broker redirected us to, or "" when the connection ended otherwise.
+func subscribeOnce(connect *protocol.Packet, subs *subscriptions, qos byte, brokerAddr, brokerName string, commands <-chan *protocol.Packet) string {
 	// Connect to the broker
 	conn, err := net.Dial("tcp", brokerAddr)
 	if err != nil {
 		fmt.Printf("[%s] Error connecting to broker: %v\n", brokerName, err)
-		return
+		return ""
 	}
 	defer conn.Close()
 
-	fmt.Printf("[%s] Connected to broker at %s. Subscribing to topic: %s\n", brokerName, brokerAddr, topic)
+	topics := subs.list()
+	fmt.Printf("[%s] Connected to broker at %s. Subscribing to topics: %s\n", brokerName, brokerAddr, strings.Join(topics, ", "))
 
-	// Send SUBSCRIBE packet: SUBSCRIBE|TOPIC
-	subscribePacket := fmt.Sprintf("SUBSCRIBE|%s\n", topic)
-	_, err = conn.Write([]byte(subscribePacket))
-	if err != nil {
-		fmt.Printf("[%s] Error sending subscription: %v\n", brokerName, err)
-		return
+	// Register the will and resume the session before subscribing
+	if connect != nil {
+		if err := protocol.Write(conn, connect); err != nil {
+			fmt.Printf("[%s] Error sending CONNECT: %v\n", brokerName, err)
+			return ""
+		}
+	}
+
+	// Send one SUBSCRIBE packet per topic
+	for _, topic := range topics {
+		subscribePacket := &protocol.Packet{Type: protocol.SUBSCRIBE, Topic: topic}
+		subscribePacket.SetQoS(qos)
+		err = protocol.Write(conn, subscribePacket)
+		if err != nil {
+			fmt.Printf("[%s] Error sending subscription: %v\n", brokerName, err)
+			return ""
+		}
 	}
 
+	// Forward SUBSCRIBE/UNSUBSCRIBE commands typed by the user
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		for {
+			select {
+			case packet := <-commands:
+				if err := protocol.Write(conn, packet); err != nil {
+					fmt.Printf("[%s] Error sending %s: %v\n", brokerName, packet.Type, err)
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+
 	fmt.Printf("[%s] Waiting for messages...\n", brokerName)
 
 	// Keep receiving messages from broker
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		message := scanner.Text()
-		fmt.Printf("[%s] Received: %s\n", brokerName, message)
+	decoder := protocol.NewDecoder(conn)
+	for {
+		message, err := decoder.Decode()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("[%s] Connection closed: %v\n", brokerName, err)
+			}
+			return ""
+		}
+		if message.Type == protocol.DISCONNECT && message.Topic != "" {
+			return message.Topic
+		}
+		if message.Type != protocol.PUBLISH {
+			continue
+		}
+
+		if fresh(message.Epoch) {
+			dup := ""
+			if message.Dup() {
+				dup = " (retransmission)"
+			}
+			fmt.Printf("[%s] Received on '%s': %s%s%s\n", brokerName, message.Topic, message.Payload, dup, formatHeaders(message.Headers))
+		} else {
+			fmt.Printf("[%s] Ignoring message from stale epoch %d on '%s': %s\n", brokerName, message.Epoch, message.Topic, message.Payload)
+		}
+
+		// Acknowledge QoS 1 deliveries so the broker stops retransmitting
+		if message.QoS() >= protocol.AtLeastOnce {
+			puback := &protocol.Packet{Type: protocol.PUBACK, ID: message.ID}
+			if err := protocol.Write(conn, puback); err != nil {
+				fmt.Printf("[%s] Error sending PUBACK: %v\n", brokerName, err)
+				return ""
+			}
+		}
+	}
+}
+
+// parseCommand turns "sub <topic>" or "unsub <topic>" into a packet. A
+// SUBSCRIBE requests the given QoS.
+func parseCommand(line string, qos byte) (*protocol.Packet, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("expected: sub <topic> | unsub <topic>")
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("[%s] Connection closed: %v\n", brokerName, err)
+	switch strings.ToLower(fields[0]) {
+	case "sub", "subscribe":
+		packet := &protocol.Packet{Type: protocol.SUBSCRIBE, Topic: fields[1]}
+		packet.SetQoS(qos)
+		return packet, nil
+	case "unsub", "unsubscribe":
+		return &protocol.Packet{Type: protocol.UNSUBSCRIBE, Topic: fields[1]}, nil
 	}
+	return nil, fmt.Errorf("unknown command %q", fields[0])
 }
 
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: go run cmd/subscriber/main.go <topic> <primary-host:port> <backup-host:port>")
+	willTopic := flag.String("will-topic", "", "topic of the will message published if this subscriber dies without saying goodbye")
+	willMessage := flag.String("will-message", "", "payload of the will message")
+	willRetain := flag.Bool("will-retain", false, "publish the will message as a retained message")
+	qos := flag.Uint("qos", 0, "requested QoS: 0 (at most once) or 1 (at least once)")
+	clientID := flag.String("client-id", "", "client ID of a persistent session: subscriptions survive disconnects and missed messages are delivered on reconnect")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run cmd/subscriber/main.go [flags] <topic>[,<topic>...] <primary-host:port> <backup-host:port> [<host:port>...]")
+		fmt.Println("  Further addresses name more members of a broker cluster")
+		fmt.Println("  While running, type 'sub <topic>' or 'unsub <topic>' to change subscriptions")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		flag.Usage()
 		return
 	}
 
-	topic := os.Args[1]
-	primaryAddr := os.Args[2]
-	backupAddr := os.Args[3]
+	topics := &subscriptions{topics: strings.Split(flag.Arg(0), ",")}
+	primaryAddr := flag.Arg(1)
+	backupAddr := flag.Arg(2)
+
+	var connect *protocol.Packet
+	if *willTopic != "" || *clientID != "" {
+		connect = &protocol.Packet{Type: protocol.CONNECT, Topic: *willTopic, Payload: []byte(*willMessage), ClientID: *clientID}
+		if *willRetain {
+			connect.Flags |= protocol.FlagRetain
+		}
+	}
+
+	// Cluster members beyond the first two get a connection each as well
+	addrs := append([]string{primaryAddr, backupAddr}, flag.Args()[3:]...)
+	names := []string{"Primary", "Backup"}
+	for i := len(names); i < len(addrs); i++ {
+		names = append(names, fmt.Sprintf("Broker %d", i+1))
+	}
 
 	var wg sync.WaitGroup
+	var brokers []chan *protocol.Packet
+	for i, addr := range addrs {
+		commands := make(chan *protocol.Packet, 16)
+		brokers = append(brokers, commands)
+		wg.Add(1)
+		go subscribeToBroker(connect, topics, byte(*qos), addr, names[i], commands, &wg)
+	}
 
-	// Subscribe to Primary
-	wg.Add(1)
-	go subscribeToBroker(topic, primaryAddr, "Primary", &wg)
+	if len(addrs) == 2 {
+		fmt.Println("Subscribed to both Primary and Backup brokers. Press CTRL-C to quit")
+	} else {
+		fmt.Printf("Subscribed to %d brokers. Press CTRL-C to quit\n", len(addrs))
+	}
 
-	// Subscribe to Backup
-	wg.Add(1)
-	go subscribeToBroker(topic, backupAddr, "Backup", &wg)
+	// Say goodbye on CTRL-C so the brokers discard our will
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		fmt.Println("Disconnecting...")
+		for _, commands := range brokers {
+			select {
+			case commands <- &protocol.Packet{Type: protocol.DISCONNECT}:
+			default:
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+		os.Exit(0)
+	}()
 
-	fmt.Println("Subscribed to both Primary and Backup brokers. Press CTRL-C to quit")
+	// Apply subscription changes to all brokers
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			packet, err := parseCommand(scanner.Text(), byte(*qos))
+			if err != nil {
+				fmt.Println("Invalid command:", err)
+				continue
+			}
+			// Connections made from now on subscribe to the new set
+			topics.apply(packet)
+			for _, commands := range brokers {
+				select {
+				case commands <- packet:
+				default:
+					// Broker connection is gone or not keeping up
+				}
+			}
+		}
+	}()
 
 	wg.Wait()
 }
+
+// formatHeaders formats the headers of a message for printing, sorted by
+// key, or returns "" if there are none
+func formatHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	var pairs []string
+	for _, key := range slices.Sorted(maps.Keys(headers)) {
+		pairs = append(pairs, key+"="+headers[key])
+	}
+	return " [" + strings.Join(pairs, " ") + "]"
+}
@@ -1,32 +1,57 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"time"
+
+	"go-broker/client"
+	"go-broker/protocol"
 )
 
 type Message struct {
 	seqNum  int
 	topic   string
 	payload string
+
+	// QoS 2 state: attempts counts PUBLISH sends, recorded is set once a
+	// broker answered PUBREC and completed once it answered PUBCOMP
+	attempts  int
+	recorded  bool
+	completed bool
 }
 
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: go run cmd/test_publisher/main.go <topic> <primary-host:port> <backup-host:port>")
+	qos := flag.Uint("qos", 0, "0 waits for ACK and resends the last 5 messages on failover, 2 publishes exactly once")
+	clientID := flag.String("client-id", fmt.Sprintf("test-publisher-%d-%d", os.Getpid(), time.Now().UnixNano()), "client ID scoping QoS 2 packet IDs")
+	oneShot := flag.Bool("one-shot", false, "connect once per message instead of publishing on one connection, for QoS 0")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run cmd/test_publisher/main.go [flags] <topic> <primary-host:port> <backup-host:port>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		flag.Usage()
 		return
 	}
 
-	topic := os.Args[1]
-	primaryAddr := os.Args[2]
-	backupAddr := os.Args[3]
+	topic := flag.Arg(0)
+	primaryAddr := flag.Arg(1)
+	backupAddr := flag.Arg(2)
+	exactlyOnce := *qos == uint(protocol.ExactlyOnce)
+
+	if !exactlyOnce && !*oneShot {
+		publishPersistent(topic, primaryAddr, backupAddr)
+		return
+	}
 
 	// Keep last 5 messages
-	recentMessages := make([]Message, 0, 5)
+	recentMessages := make([]*Message, 0, 5)
 	seqNum := 1
 	usePrimary := true
 	ticker := time.NewTicker(100 * time.Millisecond) // 10 Hz = 100ms interval
@@ -37,7 +62,7 @@ func main() {
 
 	for range ticker.C {
 		payload := strconv.Itoa(seqNum)
-		msg := Message{
+		msg := &Message{
 			seqNum:  seqNum,
 			topic:   topic,
 			payload: payload,
@@ -49,6 +74,27 @@ func main() {
 			recentMessages = recentMessages[1:] // Keep only last 5
 		}
 
+		if exactlyOnce {
+			if usePrimary && !sendExactlyOnce(msg, *clientID, primaryAddr) {
+				fmt.Println("Primary failed! Finishing unacknowledged messages on Backup...")
+				usePrimary = false
+			}
+			if !usePrimary {
+				// Completed messages were replicated before PUBREC, so only
+				// the unfinished ones need to go to the backup. It
+				// deduplicates any the primary had already recorded.
+				for _, oldMsg := range recentMessages {
+					for attempt := 0; attempt < 5 && !oldMsg.completed; attempt++ {
+						if !sendExactlyOnce(oldMsg, *clientID, backupAddr) {
+							time.Sleep(500 * time.Millisecond)
+						}
+					}
+				}
+			}
+			seqNum++
+			continue
+		}
+
 		var success bool
 		if usePrimary {
 			success = sendMessageWithAck(topic, payload, primaryAddr, true)
@@ -71,6 +117,103 @@ func main() {
 	}
 }
 
+// publishPersistent publishes at 10 Hz on one connection. The client
+// library fails over and resends the last 5 messages to the backup.
+func publishPersistent(topic, primaryAddr, backupAddr string) {
+	c, err := client.New(client.Options{
+		Brokers: []string{primaryAddr, backupAddr},
+		Logf: func(format string, args ...any) {
+			fmt.Printf(format+"\n", args...)
+		},
+	})
+	if err != nil {
+		fmt.Println("Error creating client:", err)
+		return
+	}
+	defer c.Close()
+
+	ticker := time.NewTicker(100 * time.Millisecond) // 10 Hz = 100ms interval
+	defer ticker.Stop()
+
+	fmt.Printf("Starting test publisher: topic=%s, primary=%s, backup=%s\n", topic, primaryAddr, backupAddr)
+	fmt.Println("Sending messages at 10 Hz (every 100ms) on one connection")
+
+	for seqNum := 1; ; seqNum++ {
+		<-ticker.C
+		payload := strconv.Itoa(seqNum)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := c.Publish(ctx, topic, []byte(payload))
+		cancel()
+		if err != nil {
+			fmt.Printf("Message %s not published: %v\n", payload, err)
+			continue
+		}
+		fmt.Printf("Published and ACKed: %s\n", payload)
+	}
+}
+
+// sendExactlyOnce runs the QoS 2 exchange for msg with one broker, using
+// the sequence number as packet ID. Once a broker has answered PUBREC only
+// PUBREL is sent again: resending the PUBLISH after its release could
+// deliver it twice.
+func sendExactlyOnce(msg *Message, clientID, brokerAddr string) bool {
+	conn, err := net.Dial("tcp", brokerAddr)
+	if err != nil {
+		fmt.Println("Error connecting to broker:", err)
+		return false
+	}
+	defer conn.Close()
+
+	id := uint64(msg.seqNum)
+	decoder := protocol.NewDecoder(conn)
+
+	if !msg.recorded {
+		publishPacket := &protocol.Packet{Type: protocol.PUBLISH, Topic: msg.topic, Payload: []byte(msg.payload), ID: id, ClientID: clientID}
+		publishPacket.SetQoS(protocol.ExactlyOnce)
+		if msg.attempts > 0 {
+			publishPacket.Flags |= protocol.FlagDup
+		}
+		if err := protocol.Write(conn, publishPacket); err != nil {
+			fmt.Println("Error sending message:", err)
+			return false
+		}
+		msg.attempts++
+		if !awaitReply(conn, decoder, protocol.PUBREC, id) {
+			fmt.Printf("Timeout waiting for PUBREC (message: %s)\n", msg.payload)
+			return false
+		}
+		msg.recorded = true
+	}
+
+	release := &protocol.Packet{Type: protocol.PUBREL, ID: id, ClientID: clientID}
+	if err := protocol.Write(conn, release); err != nil {
+		fmt.Println("Error sending PUBREL:", err)
+		return false
+	}
+	if !awaitReply(conn, decoder, protocol.PUBCOMP, id) {
+		fmt.Printf("Timeout waiting for PUBCOMP (message: %s)\n", msg.payload)
+		return false
+	}
+
+	msg.completed = true
+	fmt.Printf("Published exactly once: %s\n", msg.payload)
+	return true
+}
+
+// awaitReply waits up to 500ms for a reply of the given type and packet ID
+func awaitReply(conn net.Conn, decoder *protocol.Decoder, replyType protocol.PacketType, id uint64) bool {
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		response, err := decoder.Decode()
+		if err != nil {
+			return false
+		}
+		if response.Type == replyType && response.ID == id {
+			return true
+		}
+	}
+}
+
 func sendMessageWithAck(topic, message, brokerAddr string, waitForAck bool) bool {
 	// Connect to the broker
 	conn, err := net.Dial("tcp", brokerAddr)
@@ -80,9 +223,9 @@ func sendMessageWithAck(topic, message, brokerAddr string, waitForAck bool) bool
 	}
 	defer conn.Close()
 
-	// Send PUBLISH packet: PUBLISH|TOPIC|MESSAGE
-	publishPacket := fmt.Sprintf("PUBLISH|%s|%s\n", topic, message)
-	_, err = conn.Write([]byte(publishPacket))
+	// Send PUBLISH packet
+	publishPacket := &protocol.Packet{Type: protocol.PUBLISH, Topic: topic, Payload: []byte(message)}
+	err = protocol.Write(conn, publishPacket)
 	if err != nil {
 		fmt.Println("Error sending message:", err)
 		return false
@@ -95,16 +238,15 @@ func sendMessageWithAck(topic, message, brokerAddr string, waitForAck bool) bool
 
 	// Wait for ACK with 500ms timeout
 	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
+	response, err := protocol.NewDecoder(conn).Decode()
 
 	if err != nil {
 		fmt.Printf("Timeout waiting for ACK (message: %s)\n", message)
 		return false
 	}
 
-	if response == "ACK\n" {
-		fmt.Printf("Published and ACKed: %s\n", message)
+	if response.Type == protocol.ACK {
+		fmt.Printf("Published and ACKed: %s (epoch %d)\n", message, response.Epoch)
 		return true
 	}
 
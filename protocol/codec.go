@@ -0,0 +1,230 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedVersion is returned for frames written by an incompatible encoder.
+	ErrUnsupportedVersion = errors.New("protocol: unsupported frame version")
+	// ErrUnknownType is returned for packets with an unknown control type.
+	ErrUnknownType = errors.New("protocol: unknown packet type")
+	// ErrTooLarge is returned when a topic, payload or legacy line exceeds its limit.
+	ErrTooLarge = errors.New("protocol: packet too large")
+	// ErrMalformed is returned for legacy lines that do not match TYPE|TOPIC[|PAYLOAD].
+	ErrMalformed = errors.New("protocol: invalid packet format")
+)
+
+// Encode serializes p as a binary frame
+func Encode(p *Packet) ([]byte, error) {
+	properties := encodeProperties(p)
+	if len(p.Topic) > MaxTopicSize || len(p.Payload) > MaxPayloadSize || len(properties) > MaxTopicSize {
+		return nil, ErrTooLarge
+	}
+
+	flags := p.Flags &^ FlagProperties
+	size := HeaderSize + len(p.Topic) + len(p.Payload)
+	if properties != nil {
+		flags |= FlagProperties
+		size += 2 + len(properties)
+	}
+
+	buf := make([]byte, HeaderSize, size)
+	buf[0] = Magic
+	buf[1] = Version
+	buf[2] = byte(p.Type)
+	buf[3] = flags
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(p.Topic)))
+	binary.BigEndian.PutUint32(buf[6:10], uint32(len(p.Payload)))
+	if properties != nil {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(properties)))
+		buf = append(buf, properties...)
+	}
+	buf = append(buf, p.Topic...)
+	buf = append(buf, p.Payload...)
+	return buf, nil
+}
+
+// EncodeLegacy serializes p in the newline-terminated text format.
+//
+// Old clients expect bare replies: ACK and PONG are written as their name
+// alone and a PUBLISH delivered to a subscriber is written as its payload.
+func EncodeLegacy(p *Packet) []byte {
+	switch p.Type {
+	case ACK, PONG:
+		return []byte(p.Type.String() + "\n")
+	case PUBLISH:
+		return append(append([]byte{}, p.Payload...), '\n')
+	}
+	return []byte(fmt.Sprintf("%s|%s|%s\n", p.Type, p.Topic, p.Payload))
+}
+
+// Write encodes p as a binary frame and writes it to w in a single call
+func Write(w io.Writer, p *Packet) error {
+	frame, err := Encode(p)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// WriteLegacy writes p to w in the legacy text format
+func WriteLegacy(w io.Writer, p *Packet) error {
+	_, err := w.Write(EncodeLegacy(p))
+	return err
+}
+
+// Decoder reads packets from a stream that may mix binary frames and
+// legacy text lines.
+//
+// Bytes that have been read but do not yet form a complete packet are kept
+// across calls, so a read deadline expiring in the middle of a frame does
+// not lose data: the caller can simply call Decode again later.
+type Decoder struct {
+	r   io.Reader
+	buf []byte
+	tmp []byte
+}
+
+// NewDecoder creates a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:   r,
+		tmp: make([]byte, 4096),
+	}
+}
+
+// Decode returns the next packet from the stream
+func (d *Decoder) Decode() (*Packet, error) {
+	for {
+		packet, n, err := parse(d.buf)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			d.buf = append(d.buf[:0], d.buf[n:]...)
+		}
+		if packet != nil {
+			return packet, nil
+		}
+		if n > 0 {
+			// Skipped a blank legacy line, look at the rest of the buffer
+			continue
+		}
+
+		read, err := d.r.Read(d.tmp)
+		d.buf = append(d.buf, d.tmp[:read]...)
+		if read > 0 {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(d.buf) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// parse tries to decode one packet from the front of buf. It returns the
+// number of bytes consumed, which is zero when buf holds an incomplete packet.
+func parse(buf []byte) (*Packet, int, error) {
+	if len(buf) == 0 {
+		return nil, 0, nil
+	}
+	if buf[0] == Magic {
+		return parseFrame(buf)
+	}
+	return parseLegacy(buf)
+}
+
+func parseFrame(buf []byte) (*Packet, int, error) {
+	if len(buf) < HeaderSize {
+		return nil, 0, nil
+	}
+	if buf[1] != Version {
+		return nil, 0, ErrUnsupportedVersion
+	}
+
+	packetType := PacketType(buf[2])
+	if _, ok := packetTypeNames[packetType]; !ok {
+		return nil, 0, ErrUnknownType
+	}
+
+	flags := buf[3]
+	topicLen := int(binary.BigEndian.Uint16(buf[4:6]))
+	payloadLen := int(binary.BigEndian.Uint32(buf[6:10]))
+	if payloadLen > MaxPayloadSize {
+		return nil, 0, ErrTooLarge
+	}
+
+	propertiesEnd := HeaderSize
+	if flags&FlagProperties != 0 {
+		if len(buf) < HeaderSize+2 {
+			return nil, 0, nil
+		}
+		propertiesEnd += 2 + int(binary.BigEndian.Uint16(buf[HeaderSize:HeaderSize+2]))
+	}
+
+	total := propertiesEnd + topicLen + payloadLen
+	if len(buf) < total {
+		return nil, 0, nil
+	}
+
+	topicEnd := propertiesEnd + topicLen
+	packet := &Packet{
+		Type:    packetType,
+		Flags:   flags &^ FlagProperties,
+		Topic:   string(buf[propertiesEnd:topicEnd]),
+		Payload: append([]byte{}, buf[topicEnd:total]...),
+	}
+	if flags&FlagProperties != 0 {
+		if err := decodeProperties(buf[HeaderSize+2:propertiesEnd], packet); err != nil {
+			return nil, 0, err
+		}
+	}
+	return packet, total, nil
+}
+
+// parseLegacy parses the packet format: CONTROLTYPE|TOPIC|PAYLOAD
+func parseLegacy(buf []byte) (*Packet, int, error) {
+	end := bytes.IndexByte(buf, '\n')
+	if end < 0 {
+		if len(buf) > MaxLegacyLineSize {
+			return nil, 0, ErrTooLarge
+		}
+		return nil, 0, nil
+	}
+
+	line := strings.TrimSpace(string(buf[:end]))
+	if line == "" {
+		return nil, end + 1, nil
+	}
+
+	parts := strings.SplitN(line, "|", 3)
+	if len(parts) < 2 {
+		return nil, 0, ErrMalformed
+	}
+
+	packetType, ok := ParsePacketType(strings.TrimSpace(parts[0]))
+	if !ok {
+		return nil, 0, ErrUnknownType
+	}
+	payload := ""
+	if len(parts) == 3 {
+		payload = strings.TrimSpace(parts[2])
+	}
+
+	return &Packet{
+		Type:    packetType,
+		Topic:   strings.TrimSpace(parts[1]),
+		Payload: []byte(payload),
+		Legacy:  true,
+	}, end + 1, nil
+}
@@ -0,0 +1,211 @@
+// Package protocol implements the wire format shared by the broker,
+// the backup broker, publishers and subscribers.
+//
+// Every packet is sent as a length-prefixed binary frame:
+//
+//	+-------+---------+------+-------+-----------+-------------+-------+---------+
+//	| magic | version | type | flags | topic len | payload len | topic | payload |
+//	|  1 B  |   1 B   | 1 B  |  1 B  | 2 B (BE)  |  4 B (BE)   |       |         |
+//	+-------+---------+------+-------+-----------+-------------+-------+---------+
+//
+// Topic and payload are opaque bytes, so payloads may contain newlines,
+// pipes, surrounding whitespace or arbitrary binary data.
+//
+// When FlagProperties is set, a property block sits between the header and
+// the topic: a 2 byte length followed by (id 1 B, length 2 B, value)
+// entries. Decoders skip property ids they do not know.
+//
+// For old clients the decoder also accepts the legacy newline-terminated
+// text format CONTROLTYPE|TOPIC|PAYLOAD on the same connection. The first
+// byte of a binary frame is never printable ASCII, which is how the two
+// formats are told apart.
+package protocol
+
+import "fmt"
+
+const (
+	// Magic is the first byte of every binary frame.
+	Magic byte = 0xB7
+	// Version is the frame format version written by this package.
+	Version byte = 1
+
+	// HeaderSize is the size of the fixed frame header in bytes.
+	HeaderSize = 10
+	// MaxTopicSize is the largest topic a frame can carry.
+	MaxTopicSize = 1<<16 - 1
+	// MaxPayloadSize is the largest payload accepted by the decoder.
+	MaxPayloadSize = 16 << 20
+	// MaxLegacyLineSize is the longest legacy text line accepted by the decoder.
+	MaxLegacyLineSize = 64 << 10
+)
+
+// PacketType represents the control packet type
+type PacketType byte
+
+const (
+	PUBLISH PacketType = iota + 1
+	SUBSCRIBE
+	REPLICATE
+	CLEAR
+	ACK
+	PING
+	PONG
+	UNSUBSCRIBE
+	// CONNECT registers the client's Last Will and Testament: Topic and
+	// Payload are the will message, FlagRetain asks for it to be retained
+	// and an empty Topic registers no will. A ClientID resumes the
+	// client's persistent session.
+	CONNECT
+	// DISCONNECT is the clean goodbye that discards the will. Sent by a
+	// broker, it closes the connection and Topic names the broker the
+	// client should use instead.
+	DISCONNECT
+	// PUBACK acknowledges a QoS 1 PUBLISH, identified by its ID.
+	PUBACK
+	// PUBREC, PUBREL and PUBCOMP complete a QoS 2 PUBLISH in two phases:
+	// the receiver records the ID and answers PUBREC, the sender releases
+	// the ID with PUBREL and the receiver forgets it and answers PUBCOMP.
+	PUBREC
+	PUBREL
+	PUBCOMP
+	// SESSION replicates a change of a persistent session from the primary
+	// to the backup. ClientID names the session and Payload the change:
+	// "subscribe" (Topic is the filter, the QoS flags the granted level),
+	// "unsubscribe" (Topic is the filter), "online" or "offline".
+	SESSION
+	// SNAPSHOT brackets the state a primary sends a backup when the
+	// replication connection is (re)established. Payload is "begin", with
+	// Seq set to the primary's last sequence number, or "end", which the
+	// backup echoes once it has applied the snapshot.
+	SNAPSHOT
+	// RETAINED carries one retained message in a snapshot.
+	RETAINED
+	// FAILBACK hands leadership from a backup in charge back to its
+	// recovered primary after a snapshot. Epoch is the epoch the primary
+	// takes over with; it answers ACK once it is in charge.
+	FAILBACK
+	// RAFT carries a Raft message between the members of a broker cluster
+	// in Payload. The reply is a RAFT packet on the same connection.
+	RAFT
+)
+
+// Packet flags
+const (
+	// FlagRetain asks the broker to keep a PUBLISH as the topic's retained
+	// message. A retained PUBLISH with an empty payload clears it.
+	FlagRetain byte = 1 << 0
+	// FlagQoS holds the two bit quality of service level of a PUBLISH or
+	// the requested level of a SUBSCRIBE.
+	FlagQoS byte = 3 << 1
+	// FlagDup marks a retransmission of a PUBLISH the receiver may have seen.
+	FlagDup byte = 1 << 3
+	// FlagProperties is set by the encoder when a property block follows
+	// the header. It is never visible in a decoded Packet.
+	FlagProperties byte = 1 << 7
+)
+
+// Quality of service levels
+const (
+	// AtMostOnce deliveries are fire and forget.
+	AtMostOnce byte = 0
+	// AtLeastOnce deliveries are retransmitted until the receiver sends PUBACK.
+	AtLeastOnce byte = 1
+	// ExactlyOnce publishes are deduplicated by the receiver using the
+	// PUBREC/PUBREL/PUBCOMP exchange.
+	ExactlyOnce byte = 2
+)
+
+var packetTypeNames = map[PacketType]string{
+	PUBLISH:     "PUBLISH",
+	SUBSCRIBE:   "SUBSCRIBE",
+	REPLICATE:   "REPLICATE",
+	CLEAR:       "CLEAR",
+	ACK:         "ACK",
+	PING:        "PING",
+	PONG:        "PONG",
+	UNSUBSCRIBE: "UNSUBSCRIBE",
+	CONNECT:     "CONNECT",
+	DISCONNECT:  "DISCONNECT",
+	PUBACK:      "PUBACK",
+	PUBREC:      "PUBREC",
+	PUBREL:      "PUBREL",
+	PUBCOMP:     "PUBCOMP",
+	SESSION:     "SESSION",
+	SNAPSHOT:    "SNAPSHOT",
+	RETAINED:    "RETAINED",
+	FAILBACK:    "FAILBACK",
+	RAFT:        "RAFT",
+}
+
+// String returns the name used for t in the legacy text format
+func (t PacketType) String() string {
+	if name, ok := packetTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("PacketType(%d)", byte(t))
+}
+
+// ParsePacketType looks up a packet type by its legacy text name
+func ParsePacketType(name string) (PacketType, bool) {
+	for t, n := range packetTypeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// Packet represents a decoded control packet
+type Packet struct {
+	Type    PacketType
+	Flags   byte
+	Topic   string
+	Payload []byte
+
+	// ID identifies a QoS 1 or 2 PUBLISH and its acknowledgements.
+	// Zero means no ID.
+	ID uint64
+	// ClientID identifies the sending client. Packet IDs of QoS 2
+	// publishes are only unique per client.
+	ClientID string
+	// Seq is the sequence number the primary assigned to a PUBLISH. It
+	// identifies the message in REPLICATE and CLEAR. Zero means none.
+	Seq uint64
+	// Epoch is the leadership epoch of the broker that sent the packet.
+	// It grows with every takeover, so a receiver can tell a replaced
+	// leader from the current one. Zero means none.
+	Epoch uint64
+	// Headers are user properties of a PUBLISH, such as a content type or
+	// a trace ID, delivered to subscribers along with the payload. The
+	// legacy text format cannot carry them.
+	Headers map[string]string
+
+	// Legacy is set by the decoder when the packet arrived as a text line.
+	// Replies to such packets should be written with WriteLegacy.
+	Legacy bool
+}
+
+// Retain reports whether FlagRetain is set
+func (p *Packet) Retain() bool {
+	return p.Flags&FlagRetain != 0
+}
+
+// QoS returns the quality of service level carried in the flags
+func (p *Packet) QoS() byte {
+	return (p.Flags & FlagQoS) >> 1
+}
+
+// SetQoS stores a quality of service level in the flags
+func (p *Packet) SetQoS(qos byte) {
+	p.Flags = p.Flags&^FlagQoS | (qos<<1)&FlagQoS
+}
+
+// Dup reports whether FlagDup is set
+func (p *Packet) Dup() bool {
+	return p.Flags&FlagDup != 0
+}
+
+// String formats the packet for logging
+func (p *Packet) String() string {
+	return fmt.Sprintf("%s|%s|%s", p.Type, p.Topic, p.Payload)
+}
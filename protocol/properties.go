@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"maps"
+	"slices"
+)
+
+// Property ids
+const (
+	// PropID carries Packet.ID as an 8 byte big endian integer.
+	PropID byte = 1
+	// PropClientID carries Packet.ClientID as a UTF-8 string.
+	PropClientID byte = 2
+	// PropSeq carries Packet.Seq as an 8 byte big endian integer.
+	PropSeq byte = 3
+	// PropEpoch carries Packet.Epoch as an 8 byte big endian integer.
+	PropEpoch byte = 4
+	// PropUserProperty carries one entry of Packet.Headers: a 2 byte big
+	// endian key length, the key and the value, both UTF-8 strings. A
+	// packet has one such property per header.
+	PropUserProperty byte = 5
+)
+
+// ErrMalformedProperties is returned for a property block that does not parse.
+var ErrMalformedProperties = errors.New("protocol: malformed property block")
+
+// appendProperty appends one property entry to buf
+func appendProperty(buf []byte, id byte, value []byte) []byte {
+	buf = append(buf, id)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// encodeProperties returns the property entries of p, or nil if it has none
+func encodeProperties(p *Packet) []byte {
+	var buf []byte
+	if p.ID != 0 {
+		buf = appendProperty(buf, PropID, binary.BigEndian.AppendUint64(nil, p.ID))
+	}
+	if p.ClientID != "" {
+		buf = appendProperty(buf, PropClientID, []byte(p.ClientID))
+	}
+	if p.Seq != 0 {
+		buf = appendProperty(buf, PropSeq, binary.BigEndian.AppendUint64(nil, p.Seq))
+	}
+	if p.Epoch != 0 {
+		buf = appendProperty(buf, PropEpoch, binary.BigEndian.AppendUint64(nil, p.Epoch))
+	}
+	// Sorted, so equal packets encode the same
+	for _, key := range slices.Sorted(maps.Keys(p.Headers)) {
+		value := binary.BigEndian.AppendUint16(nil, uint16(len(key)))
+		value = append(value, key...)
+		value = append(value, p.Headers[key]...)
+		buf = appendProperty(buf, PropUserProperty, value)
+	}
+	return buf
+}
+
+// decodeProperties parses property entries into p
+func decodeProperties(buf []byte, p *Packet) error {
+	for len(buf) > 0 {
+		if len(buf) < 3 {
+			return ErrMalformedProperties
+		}
+		id := buf[0]
+		size := int(binary.BigEndian.Uint16(buf[1:3]))
+		if len(buf) < 3+size {
+			return ErrMalformedProperties
+		}
+		value := buf[3 : 3+size]
+		buf = buf[3+size:]
+
+		switch id {
+		case PropID:
+			if size != 8 {
+				return ErrMalformedProperties
+			}
+			p.ID = binary.BigEndian.Uint64(value)
+		case PropClientID:
+			p.ClientID = string(value)
+		case PropSeq:
+			if size != 8 {
+				return ErrMalformedProperties
+			}
+			p.Seq = binary.BigEndian.Uint64(value)
+		case PropEpoch:
+			if size != 8 {
+				return ErrMalformedProperties
+			}
+			p.Epoch = binary.BigEndian.Uint64(value)
+		case PropUserProperty:
+			if size < 2 || size < 2+int(binary.BigEndian.Uint16(value)) {
+				return ErrMalformedProperties
+			}
+			keyEnd := 2 + int(binary.BigEndian.Uint16(value))
+			if p.Headers == nil {
+				p.Headers = make(map[string]string)
+			}
+			p.Headers[string(value[2:keyEnd])] = string(value[keyEnd:])
+		}
+	}
+	return nil
+}
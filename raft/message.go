@@ -0,0 +1,179 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MessageType identifies a Raft RPC or its reply
+type MessageType byte
+
+const (
+	// RequestVote asks for a vote in an election. LogIndex and LogTerm
+	// describe the last entry of the candidate's log.
+	RequestVote MessageType = iota + 1
+	// RequestVoteReply grants the vote if Success is set.
+	RequestVoteReply
+	// AppendEntries replicates Entries following the entry at LogIndex
+	// with LogTerm, and tells the follower the leader's Commit index.
+	// Without entries it is a heartbeat.
+	AppendEntries
+	// AppendEntriesReply reports in Match the last index the follower
+	// holds in agreement with the leader if Success is set, or else where
+	// the leader should retry from.
+	AppendEntriesReply
+)
+
+var messageTypeNames = map[MessageType]string{
+	RequestVote:        "RequestVote",
+	RequestVoteReply:   "RequestVoteReply",
+	AppendEntries:      "AppendEntries",
+	AppendEntriesReply: "AppendEntriesReply",
+}
+
+// String returns the name of the message type
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(%d)", byte(t))
+}
+
+// Entry is one command in the replicated log
+type Entry struct {
+	Index uint64
+	Term  uint64
+	// Data is the command. Each leader starts its term with an entry
+	// without data.
+	Data []byte
+}
+
+// Message is a Raft RPC or its reply
+type Message struct {
+	Type MessageType
+	Term uint64
+	From string // ID of the sending node
+
+	LogIndex uint64
+	LogTerm  uint64
+	Entries  []Entry
+	Commit   uint64
+
+	Success bool
+	Match   uint64
+}
+
+var errShortMessage = errors.New("raft: short message")
+
+// MarshalBinary encodes the message as
+//
+//	type (1 B) | term (8 B) | from len (2 B) | from | log index (8 B) |
+//	log term (8 B) | commit (8 B) | success (1 B) | match (8 B) |
+//	entry count (4 B) | entries
+//
+// with every entry as index (8 B) | term (8 B) | data len (4 B) | data.
+// Integers are big endian.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if len(m.From) > 1<<16-1 {
+		return nil, fmt.Errorf("raft: node ID too long (%d bytes)", len(m.From))
+	}
+	size := 1 + 8 + 2 + len(m.From) + 8 + 8 + 8 + 1 + 8 + 4
+	for _, e := range m.Entries {
+		size += 20 + len(e.Data)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, byte(m.Type))
+	buf = binary.BigEndian.AppendUint64(buf, m.Term)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.From)))
+	buf = append(buf, m.From...)
+	buf = binary.BigEndian.AppendUint64(buf, m.LogIndex)
+	buf = binary.BigEndian.AppendUint64(buf, m.LogTerm)
+	buf = binary.BigEndian.AppendUint64(buf, m.Commit)
+	if m.Success {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.BigEndian.AppendUint64(buf, m.Match)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Entries)))
+	for _, e := range m.Entries {
+		buf = binary.BigEndian.AppendUint64(buf, e.Index)
+		buf = binary.BigEndian.AppendUint64(buf, e.Term)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(e.Data)))
+		buf = append(buf, e.Data...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a message written by MarshalBinary
+func (m *Message) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	m.Type = MessageType(r.byte())
+	m.Term = r.uint64()
+	m.From = string(r.bytes(int(r.uint16())))
+	m.LogIndex = r.uint64()
+	m.LogTerm = r.uint64()
+	m.Commit = r.uint64()
+	m.Success = r.byte() != 0
+	m.Match = r.uint64()
+	count := r.uint32()
+	m.Entries = nil
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		e := Entry{Index: r.uint64(), Term: r.uint64()}
+		e.Data = r.bytes(int(r.uint32()))
+		m.Entries = append(m.Entries, e)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if _, ok := messageTypeNames[m.Type]; !ok {
+		return fmt.Errorf("raft: unknown message type %d", byte(m.Type))
+	}
+	return nil
+}
+
+// reader consumes a byte slice, remembering the first error
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errShortMessage
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
@@ -0,0 +1,633 @@
+// Package raft implements the Raft consensus algorithm a broker cluster
+// uses to agree on one replicated log and on the leader that appends to it.
+//
+// A Node elects a leader among its peers, replicates the entries the leader
+// proposes and hands every entry to the application once a majority of the
+// cluster stored it. The cluster keeps working as long as a majority of its
+// nodes can reach each other. Messages between nodes go through a Transport
+// the application provides; incoming messages are passed to Node.Handle.
+//
+// Term, vote and log are kept in a directory, so a node can rejoin after a
+// restart. The log is not compacted: a restarted node applies it again from
+// the first entry.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults for zero Config fields
+const (
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultElectionTimeout   = 500 * time.Millisecond
+)
+
+// maxAppendEntries and maxAppendBytes bound the entries sent in one
+// AppendEntries
+const (
+	maxAppendEntries = 64
+	maxAppendBytes   = 1 << 20
+)
+
+var (
+	// ErrNotLeader is returned when proposing to a node that is not the leader.
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrDiscarded is returned by Wait when a new leader replaced the entry.
+	ErrDiscarded = errors.New("raft: entry discarded by a new leader")
+	// ErrTimeout is returned by Wait when the entry was not committed in time.
+	ErrTimeout = errors.New("raft: entry not committed in time")
+	// ErrStopped is returned by operations on a stopped node.
+	ErrStopped = errors.New("raft: node stopped")
+)
+
+// Transport sends a message to another node and returns its reply
+type Transport interface {
+	Call(peer string, m *Message) (*Message, error)
+}
+
+// Config configures a node
+type Config struct {
+	// ID identifies the node. Peers name each other by ID, so it is
+	// usually the address the other nodes reach it at.
+	ID string
+	// Peers are the IDs of the other nodes of the cluster.
+	Peers []string
+	// Dir holds the persistent state. Empty keeps it in memory, which is
+	// only safe if a node never restarts with the same ID.
+	Dir string
+	// HeartbeatInterval is how often the leader contacts every follower.
+	// Zero selects DefaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is how long a follower waits for the leader before
+	// it starts an election, randomized up to twice the value. Zero
+	// selects DefaultElectionTimeout.
+	ElectionTimeout time.Duration
+	// Transport carries messages to the peers.
+	Transport Transport
+}
+
+// role is the part a node currently plays in the cluster
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Node is one member of a Raft cluster
+type Node struct {
+	config Config
+
+	mu       sync.Mutex
+	changed  *sync.Cond // signalled when commitIndex, the role or the term changes
+	role     role
+	term     uint64
+	votedFor string
+	leader   string  // ID of the current leader, empty if unknown
+	log      []Entry // log[0] is an empty entry, so log[i].Index == i
+
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+
+	electionDeadline time.Time
+
+	store   *store // nil when the state is kept in memory
+	wake    map[string]chan struct{}
+	applied chan Entry
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a node, loading its persistent state from config.Dir
+func New(config Config) (*Node, error) {
+	if config.ID == "" {
+		return nil, errors.New("raft: node needs an ID")
+	}
+	if config.Transport == nil && len(config.Peers) > 0 {
+		return nil, errors.New("raft: node needs a transport to reach its peers")
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+
+	n := &Node{
+		config:     config,
+		log:        []Entry{{}},
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		wake:       make(map[string]chan struct{}),
+		applied:    make(chan Entry, maxAppendEntries),
+		done:       make(chan struct{}),
+	}
+	n.changed = sync.NewCond(&n.mu)
+	for _, peer := range config.Peers {
+		n.wake[peer] = make(chan struct{}, 1)
+	}
+
+	if config.Dir != "" {
+		s, term, votedFor, entries, err := openStore(config.Dir)
+		if err != nil {
+			return nil, err
+		}
+		n.store = s
+		n.term = term
+		n.votedFor = votedFor
+		n.log = append(n.log, entries...)
+	}
+	return n, nil
+}
+
+// Start runs the election timer, replication and application goroutines
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetElectionTimer()
+	n.mu.Unlock()
+
+	go n.run()
+	go n.apply()
+	for _, peer := range n.config.Peers {
+		go n.replicateTo(peer)
+	}
+}
+
+// Stop stops the node and closes its persistent state
+func (n *Node) Stop() error {
+	var err error
+	n.stopOnce.Do(func() {
+		close(n.done)
+		n.mu.Lock()
+		n.changed.Broadcast()
+		if n.store != nil {
+			err = n.store.close()
+			n.store = nil
+		}
+		n.mu.Unlock()
+	})
+	return err
+}
+
+// Applied returns the channel on which committed entries are handed to the
+// application, in log order, each exactly once
+func (n *Node) Applied() <-chan Entry {
+	return n.applied
+}
+
+// Status returns the current term, the ID of the leader if known, and
+// whether this node is the leader
+func (n *Node) Status() (term uint64, leaderID string, isLeader bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.term, n.leader, n.role == leader
+}
+
+// Propose appends data to the log of the leader. It returns the index and
+// term of the new entry, whose commit can be awaited with Wait.
+func (n *Node) Propose(data []byte) (index, term uint64, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped() {
+		return 0, 0, ErrStopped
+	}
+	if n.role != leader {
+		return 0, 0, ErrNotLeader
+	}
+	entry, err := n.appendEntry(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	return entry.Index, entry.Term, nil
+}
+
+// Wait blocks until the entry proposed at index in term is committed. It
+// fails if another entry took its place or the timeout expires first.
+func (n *Node) Wait(index, term uint64, timeout time.Duration) error {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		n.mu.Lock()
+		expired = true
+		n.changed.Broadcast()
+		n.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		if index < uint64(len(n.log)) && n.log[index].Term != term {
+			return ErrDiscarded
+		}
+		if n.commitIndex >= index {
+			return nil
+		}
+		if n.stopped() {
+			return ErrStopped
+		}
+		if expired {
+			return ErrTimeout
+		}
+		n.changed.Wait()
+	}
+}
+
+// Handle processes a message from another node and returns the reply
+func (n *Node) Handle(m *Message) *Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch m.Type {
+	case RequestVote:
+		return n.handleRequestVote(m)
+	case AppendEntries:
+		return n.handleAppendEntries(m)
+	}
+	return nil
+}
+
+func (n *Node) stopped() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// lastEntry returns the last entry of the log. The caller must hold mu.
+func (n *Node) lastEntry() Entry {
+	return n.log[len(n.log)-1]
+}
+
+// quorum is the number of nodes that make a majority
+func (n *Node) quorum() int {
+	return (len(n.config.Peers)+1)/2 + 1
+}
+
+// resetElectionTimer picks a new random election deadline. The caller must
+// hold mu.
+func (n *Node) resetElectionTimer() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// setTerm moves to a newer term, forgetting the vote of the old one. The
+// caller must hold mu.
+func (n *Node) setTerm(term uint64) {
+	n.term = term
+	n.votedFor = ""
+	n.saveState()
+	n.changed.Broadcast()
+}
+
+// saveState persists term and vote. The caller must hold mu.
+func (n *Node) saveState() {
+	if n.store == nil {
+		return
+	}
+	if err := n.store.saveState(n.term, n.votedFor); err != nil {
+		fmt.Println("Raft: error saving state:", err)
+	}
+}
+
+// stepDown makes the node a follower, in a newer term if term is higher.
+// The caller must hold mu.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.setTerm(term)
+		n.leader = ""
+	}
+	if n.role != follower {
+		n.role = follower
+		n.changed.Broadcast()
+	}
+}
+
+// appendEntry adds a new entry of the current term to the log of the
+// leader. The caller must hold mu.
+func (n *Node) appendEntry(data []byte) (Entry, error) {
+	entry := Entry{Index: n.lastEntry().Index + 1, Term: n.term, Data: data}
+	if n.store != nil {
+		if err := n.store.append([]Entry{entry}); err != nil {
+			return Entry{}, err
+		}
+	}
+	n.log = append(n.log, entry)
+	n.advanceCommit()
+	for _, wake := range n.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	return entry, nil
+}
+
+// run starts an election whenever the leader has not been heard from
+// within the election timeout
+func (n *Node) run() {
+	ticker := time.NewTicker(n.config.HeartbeatInterval / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+
+		n.mu.Lock()
+		if n.role != leader && time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection becomes a candidate in a new term and asks every peer for
+// its vote. The caller must hold mu.
+func (n *Node) startElection() {
+	n.role = candidate
+	n.term++
+	n.votedFor = n.config.ID
+	n.leader = ""
+	n.saveState()
+	n.resetElectionTimer()
+	n.changed.Broadcast()
+	fmt.Printf("Raft: starting election for term %d\n", n.term)
+
+	last := n.lastEntry()
+	request := &Message{Type: RequestVote, Term: n.term, From: n.config.ID, LogIndex: last.Index, LogTerm: last.Term}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	for _, peer := range n.config.Peers {
+		go func(peer string) {
+			reply, err := n.config.Transport.Call(peer, request)
+			if err != nil || reply.Type != RequestVoteReply {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.stepDown(reply.Term)
+				return
+			}
+			if n.role != candidate || n.term != request.Term || !reply.Success {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over as leader of the current term. Its first entry
+// carries no data; committing it commits everything before it. The caller
+// must hold mu.
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.config.ID
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = n.lastEntry().Index + 1
+		n.matchIndex[peer] = 0
+	}
+	n.changed.Broadcast()
+	fmt.Printf("Raft: won the election for term %d\n", n.term)
+
+	if _, err := n.appendEntry(nil); err != nil {
+		fmt.Println("Raft: error appending to the log:", err)
+		n.stepDown(n.term)
+	}
+}
+
+// advanceCommit commits the newest entry of the current term that a
+// majority of the cluster stores. The caller must hold mu.
+func (n *Node) advanceCommit() {
+	if n.role != leader {
+		return
+	}
+	for index := n.lastEntry().Index; index > n.commitIndex; index-- {
+		if n.log[index].Term != n.term {
+			// Entries of older terms are only committed indirectly
+			return
+		}
+		count := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.changed.Broadcast()
+			return
+		}
+	}
+}
+
+// replicateTo sends the leader's log to one peer, and a heartbeat at least
+// every heartbeat interval
+func (n *Node) replicateTo(peer string) {
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.wake[peer]:
+		case <-n.done:
+			return
+		}
+
+		for n.sendAppendEntries(peer) {
+		}
+	}
+}
+
+// sendAppendEntries sends the entries peer is missing, up to a batch, and
+// reports whether more are waiting
+func (n *Node) sendAppendEntries(peer string) bool {
+	n.mu.Lock()
+	if n.role != leader || n.stopped() {
+		n.mu.Unlock()
+		return false
+	}
+	next := min(n.nextIndex[peer], uint64(len(n.log)))
+	end := min(uint64(len(n.log)), next+maxAppendEntries)
+	size := 0
+	for i := next; i < end; i++ {
+		size += len(n.log[i].Data)
+		if size > maxAppendBytes && i > next {
+			end = i
+		}
+	}
+	request := &Message{
+		Type:     AppendEntries,
+		Term:     n.term,
+		From:     n.config.ID,
+		LogIndex: next - 1,
+		LogTerm:  n.log[next-1].Term,
+		Entries:  append([]Entry(nil), n.log[next:end]...),
+		Commit:   n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	reply, err := n.config.Transport.Call(peer, request)
+	if err != nil || reply.Type != AppendEntriesReply {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return false
+	}
+	if n.role != leader || n.term != request.Term {
+		return false
+	}
+
+	if reply.Success {
+		match := request.LogIndex + uint64(len(request.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+			n.advanceCommit()
+		}
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+	} else {
+		// Back up to where the follower's log may agree with ours
+		n.nextIndex[peer] = max(1, min(reply.Match+1, next-1))
+	}
+	return n.nextIndex[peer] < uint64(len(n.log))
+}
+
+// handleRequestVote grants the vote to a candidate whose log is at least
+// as up to date as ours, once per term. The caller must hold mu.
+func (n *Node) handleRequestVote(m *Message) *Message {
+	if m.Term > n.term {
+		n.stepDown(m.Term)
+	}
+	reply := &Message{Type: RequestVoteReply, Term: n.term, From: n.config.ID}
+	if m.Term < n.term {
+		return reply
+	}
+
+	last := n.lastEntry()
+	upToDate := m.LogTerm > last.Term || (m.LogTerm == last.Term && m.LogIndex >= last.Index)
+	if upToDate && (n.votedFor == "" || n.votedFor == m.From) {
+		n.votedFor = m.From
+		n.saveState()
+		n.resetElectionTimer()
+		reply.Success = true
+	}
+	return reply
+}
+
+// handleAppendEntries stores the leader's entries after checking that our
+// log agrees with the leader's up to them. The caller must hold mu.
+func (n *Node) handleAppendEntries(m *Message) *Message {
+	reply := &Message{Type: AppendEntriesReply, Term: n.term, From: n.config.ID}
+	if m.Term < n.term {
+		return reply
+	}
+	n.stepDown(m.Term)
+	reply.Term = n.term
+	if n.leader != m.From {
+		n.leader = m.From
+		n.changed.Broadcast()
+	}
+	n.resetElectionTimer()
+
+	last := n.lastEntry()
+	if m.LogIndex > last.Index {
+		reply.Match = last.Index
+		return reply
+	}
+	if n.log[m.LogIndex].Term != m.LogTerm {
+		// Skip the whole conflicting term in one go
+		conflict := n.log[m.LogIndex].Term
+		index := m.LogIndex
+		for index > 1 && n.log[index-1].Term == conflict {
+			index--
+		}
+		reply.Match = index - 1
+		return reply
+	}
+
+	for i, entry := range m.Entries {
+		if entry.Index < uint64(len(n.log)) {
+			if n.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			// A conflicting suffix was never committed: drop it
+			if n.store != nil {
+				if err := n.store.truncate(entry.Index); err != nil {
+					fmt.Println("Raft: error truncating the log:", err)
+					return reply
+				}
+			}
+			n.log = n.log[:entry.Index]
+			n.changed.Broadcast()
+		}
+		if n.store != nil {
+			if err := n.store.append(m.Entries[i:]); err != nil {
+				fmt.Println("Raft: error appending to the log:", err)
+				return reply
+			}
+		}
+		n.log = append(n.log, m.Entries[i:]...)
+		break
+	}
+
+	// Only what is known to agree with the leader can be committed
+	match := m.LogIndex + uint64(len(m.Entries))
+	if commit := min(m.Commit, match); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.changed.Broadcast()
+	}
+	reply.Success = true
+	reply.Match = match
+	return reply
+}
+
+// apply hands committed entries to the application in order
+func (n *Node) apply() {
+	for {
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex && !n.stopped() {
+			n.changed.Wait()
+		}
+		if n.stopped() {
+			n.mu.Unlock()
+			return
+		}
+		entries := append([]Entry(nil), n.log[n.lastApplied+1:n.commitIndex+1]...)
+		n.lastApplied = n.commitIndex
+		n.mu.Unlock()
+
+		for _, entry := range entries {
+			select {
+			case n.applied <- entry:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The persistent state of a node lives in two files of its directory:
+//
+//   - state holds the current term and the vote cast in it, and is
+//     replaced atomically on every change.
+//   - log holds the entries, one record per entry in index order:
+//     term (8 B) | data len (4 B) | crc32 (4 B) | data. The checksum
+//     covers term and data, so a torn write at the end is cut off when
+//     the log is loaded.
+const (
+	stateFile = "state"
+	logFile   = "log"
+
+	logHeaderSize = 16
+)
+
+// store persists the term, vote and log of a node
+type store struct {
+	dir     string
+	log     *os.File
+	offsets []int64 // file offset of each entry, offsets[i] for index i+1
+	size    int64
+}
+
+// openStore opens the state in dir, creating it if needed, and returns the
+// saved term, vote and entries
+func openStore(dir string) (*store, uint64, string, []Entry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, 0, "", nil, err
+	}
+
+	term, votedFor, err := loadState(filepath.Join(dir, stateFile))
+	if err != nil {
+		return nil, 0, "", nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, "", nil, err
+	}
+	s := &store{dir: dir, log: f}
+	entries, err := s.load()
+	if err != nil {
+		f.Close()
+		return nil, 0, "", nil, err
+	}
+	return s, term, votedFor, entries, nil
+}
+
+func loadState(path string) (uint64, string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if len(data) < 10 || len(data) != 10+int(binary.BigEndian.Uint16(data[8:])) {
+		return 0, "", fmt.Errorf("raft: corrupt state file %s", path)
+	}
+	return binary.BigEndian.Uint64(data), string(data[10:]), nil
+}
+
+// load reads the entries of the log file and cuts off a torn last record
+func (s *store) load() ([]Entry, error) {
+	info, err := s.log.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(s.log)
+	var entries []Entry
+	var offset int64
+	header := make([]byte, logHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		term := binary.BigEndian.Uint64(header)
+		size := int64(binary.BigEndian.Uint32(header[8:]))
+		if offset+logHeaderSize+size > info.Size() {
+			break
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		if checksum(header[:8], data) != binary.BigEndian.Uint32(header[12:]) {
+			break
+		}
+		s.offsets = append(s.offsets, offset)
+		offset += logHeaderSize + int64(len(data))
+		entries = append(entries, Entry{Index: uint64(len(entries) + 1), Term: term, Data: data})
+	}
+
+	// Everything after the last good record is a torn write
+	if err := s.log.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := s.log.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s.size = offset
+	return entries, nil
+}
+
+func checksum(term, data []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write(term)
+	crc.Write(data)
+	return crc.Sum32()
+}
+
+// saveState replaces the saved term and vote
+func (s *store) saveState(term uint64, votedFor string) error {
+	data := binary.BigEndian.AppendUint64(nil, term)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(votedFor)))
+	data = append(data, votedFor...)
+
+	tmp := filepath.Join(s.dir, stateFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, stateFile))
+}
+
+// append writes entries after the last one and syncs them to disk
+func (s *store) append(entries []Entry) error {
+	w := bufio.NewWriter(s.log)
+	for _, e := range entries {
+		header := make([]byte, logHeaderSize)
+		binary.BigEndian.PutUint64(header, e.Term)
+		binary.BigEndian.PutUint32(header[8:], uint32(len(e.Data)))
+		binary.BigEndian.PutUint32(header[12:], checksum(header[:8], e.Data))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(e.Data); err != nil {
+			return err
+		}
+		s.offsets = append(s.offsets, s.size)
+		s.size += logHeaderSize + int64(len(e.Data))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// truncate removes the entries from index on
+func (s *store) truncate(index uint64) error {
+	if index > uint64(len(s.offsets)) {
+		return nil
+	}
+	offset := s.offsets[index-1]
+	if err := s.log.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.offsets = s.offsets[:index-1]
+	s.size = offset
+	return nil
+}
+
+func (s *store) close() error {
+	return s.log.Close()
+}
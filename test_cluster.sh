@@ -0,0 +1,127 @@
+#!/bin/bash
+
+# Test script for the Raft cluster mode
+# Runs three brokers on localhost ports, kills the leader and checks that
+# the remaining two elect a new one and keep delivering. Logs are kept in a
+# temporary directory.
+
+PORTS="9001 9002 9003"
+LOGS=$(mktemp -d)
+
+echo "=== Broker Cluster Test ==="
+echo ""
+echo "This test will:"
+echo "1. Start a 3-node cluster on ports 9001-9003"
+echo "2. Start a subscriber connected to all nodes"
+echo "3. Publish 3 messages through a member (redirected to the leader)"
+echo "4. Kill the leader"
+echo "5. Publish 3 more messages once a new leader is elected"
+echo "6. Restart the old leader and let it catch up"
+echo ""
+echo "Logs: $LOGS"
+echo ""
+
+echo "Building..."
+go build -o "$LOGS/bin/" ./cmd/server ./cmd/subscriber ./cmd/publisher || exit 1
+
+peers() {
+    local list=""
+    for p in $PORTS; do
+        [ "$p" != "$1" ] && list="$list,localhost:$p"
+    done
+    echo "${list#,}"
+}
+
+declare -A PIDS
+start_node() {
+    "$LOGS/bin/server" -cluster "$(peers $1)" -raft-dir "$LOGS/raft-$1" "$1" >> "$LOGS/node-$1.log" 2>&1 &
+    PIDS[$1]=$!
+}
+
+term_of() {
+    grep -o "Leading the cluster in term [0-9]*" "$LOGS/node-$1.log" | tail -1 | grep -o "[0-9]*$"
+}
+
+cleanup() {
+    kill "${PIDS[@]}" $SUBSCRIBER_PID 2>/dev/null
+    wait 2>/dev/null
+}
+trap cleanup EXIT
+
+for p in $PORTS; do
+    echo "Starting cluster member on port $p..."
+    start_node "$p"
+done
+sleep 3
+
+LEADER=""
+for p in $PORTS; do
+    t=$(term_of "$p")
+    [ -n "$t" ] && LEADER=$p && TERM_NO=$t
+done
+if [ -z "$LEADER" ]; then
+    echo "❌ No leader elected"
+    exit 1
+fi
+echo "✓ Leader is localhost:$LEADER (term $TERM_NO)"
+
+"$LOGS/bin/subscriber" -qos 1 topicC localhost:9001 localhost:9002 localhost:9003 > "$LOGS/subscriber.log" 2>&1 &
+SUBSCRIBER_PID=$!
+sleep 1
+
+# Publish through a member that is not the leader
+for p in $PORTS; do
+    [ "$p" != "$LEADER" ] && FOLLOWER=$p && break
+done
+for i in 1 2 3; do
+    "$LOGS/bin/publisher" topicC "message $i" "localhost:$FOLLOWER" "localhost:$FOLLOWER"
+done
+sleep 1
+
+echo ""
+echo "🔥 KILLING LEADER localhost:$LEADER (PID: ${PIDS[$LEADER]})..."
+kill -9 "${PIDS[$LEADER]}"
+unset "PIDS[$LEADER]"
+sleep 3
+
+NEW_LEADER=""
+for p in "${!PIDS[@]}"; do
+    t=$(term_of "$p")
+    [ -n "$t" ] && [ "$t" -gt "$TERM_NO" ] && NEW_LEADER=$p && TERM_NO=$t
+done
+if [ -z "$NEW_LEADER" ]; then
+    echo "❌ No new leader elected"
+    exit 1
+fi
+echo "✓ New leader is localhost:$NEW_LEADER (term $TERM_NO)"
+
+for p in "${!PIDS[@]}"; do
+    [ "$p" != "$NEW_LEADER" ] && FOLLOWER=$p
+done
+for i in 4 5 6; do
+    "$LOGS/bin/publisher" topicC "message $i" "localhost:$FOLLOWER" "localhost:$NEW_LEADER"
+done
+sleep 1
+
+echo ""
+echo "Restarting localhost:$LEADER..."
+start_node "$LEADER"
+sleep 3
+if grep -q "Cleared .*message 6" "$LOGS/node-$LEADER.log"; then
+    echo "✓ localhost:$LEADER caught up with the cluster"
+else
+    echo "❌ localhost:$LEADER did not catch up"
+fi
+
+echo ""
+echo "Subscriber received:"
+grep "Received" "$LOGS/subscriber.log"
+
+RECEIVED=$(grep -c "Received on 'topicC': message" "$LOGS/subscriber.log")
+echo ""
+if [ "$RECEIVED" -eq 6 ]; then
+    echo "✓ All 6 messages delivered exactly once"
+else
+    echo "❌ Expected 6 deliveries, got $RECEIVED"
+    exit 1
+fi
@@ -0,0 +1,512 @@
+// Package wal implements the append-only write-ahead log a broker uses to
+// keep accepted messages across restarts.
+//
+// The log is a directory of segment files named after the sequence number
+// of their first record. Each record is framed as
+//
+//	+------+----------+------------+------------+------+
+//	| kind |   seq    | data len   |   crc32    | data |
+//	| 1 B  | 8 B (BE) |  4 B (BE)  |  4 B (BE)  |      |
+//	+------+----------+------------+------------+------+
+//
+// where a message record carries an encoded protocol.Packet and a processed
+// record has no data and marks the message with the same sequence number as
+// done. The checksum covers kind, seq and data, so a torn write at the end
+// of the last segment is detected and cut off on recovery.
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-broker/protocol"
+)
+
+// SyncPolicy selects when appended records are flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every record. A message is durable before
+	// Append returns.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every Options.SyncInterval.
+	// A crash loses at most one interval of records.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// String returns the name accepted by ParseSyncPolicy
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// ParseSyncPolicy looks up a sync policy by name
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q (want always, interval or never)", name)
+}
+
+// Defaults for zero Options fields
+const (
+	DefaultSegmentSize  = 16 << 20
+	DefaultSyncInterval = 100 * time.Millisecond
+)
+
+// Options configures a log
+type Options struct {
+	// Dir is the directory holding the segment files. It is created if
+	// it does not exist.
+	Dir string
+	// SegmentSize is the size after which a new segment is started.
+	// Zero selects DefaultSegmentSize.
+	SegmentSize int64
+	// Sync is the fsync policy.
+	Sync SyncPolicy
+	// SyncInterval is the flush period of SyncInterval. Zero selects
+	// DefaultSyncInterval.
+	SyncInterval time.Duration
+}
+
+// Record is a logged message that was not marked processed
+type Record struct {
+	Seq    uint64
+	Packet *protocol.Packet
+}
+
+const (
+	kindMessage   byte = 1
+	kindProcessed byte = 2
+
+	recordHeaderSize = 17
+	segmentSuffix    = ".wal"
+)
+
+var (
+	// ErrClosed is returned by operations on a closed log.
+	ErrClosed = errors.New("wal: log closed")
+
+	errCorrupt = errors.New("wal: corrupt record")
+)
+
+// segment is one file of the log
+type segment struct {
+	base        uint64 // sequence number the segment was started at
+	path        string
+	outstanding int // messages in this segment not yet marked processed
+}
+
+// Log is an append-only write-ahead log. It is safe for concurrent use.
+type Log struct {
+	options Options
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	segments []*segment          // oldest first, the last one is written to
+	pending  map[uint64]*segment // unprocessed message -> segment holding it
+	nextSeq  uint64
+	dirty    bool // records written since the last fsync
+	closed   bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the log in options.Dir and returns it together with the
+// messages that were logged but never marked processed, oldest first.
+// A torn record at the end of the newest segment is truncated.
+func Open(options Options) (*Log, []Record, error) {
+	if options.SegmentSize == 0 {
+		options.SegmentSize = DefaultSegmentSize
+	}
+	if options.SyncInterval == 0 {
+		options.SyncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(options.Dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+
+	l := &Log{
+		options: options,
+		pending: make(map[uint64]*segment),
+		nextSeq: 1,
+		done:    make(chan struct{}),
+	}
+
+	unprocessed, err := l.recover()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(l.segments) == 0 {
+		if err := l.rotate(); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		last := l.segments[len(l.segments)-1]
+		file, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		l.file = file
+		l.size = info.Size()
+	}
+
+	if options.Sync == SyncInterval {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	return l, unprocessed, nil
+}
+
+// recover reads every segment and rebuilds the in-memory index
+func (l *Log) recover() ([]Record, error) {
+	entries, err := os.ReadDir(l.options.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		var base uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, segmentSuffix), "%d", &base); err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{base: base, path: filepath.Join(l.options.Dir, name)})
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].base < l.segments[j].base })
+
+	messages := make(map[uint64]*protocol.Packet)
+	for i, seg := range l.segments {
+		last := i == len(l.segments)-1
+		if err := l.readSegment(seg, last, messages); err != nil {
+			return nil, err
+		}
+		if seg.base > l.nextSeq {
+			l.nextSeq = seg.base
+		}
+	}
+
+	var unprocessed []Record
+	for seq, packet := range messages {
+		unprocessed = append(unprocessed, Record{Seq: seq, Packet: packet})
+	}
+	sort.Slice(unprocessed, func(i, j int) bool { return unprocessed[i].Seq < unprocessed[j].Seq })
+
+	l.trim()
+	return unprocessed, nil
+}
+
+// readSegment replays the records of seg into messages. A corrupt tail of
+// the last segment is truncated; corruption anywhere else is an error.
+func (l *Log) readSegment(seg *segment, last bool, messages map[uint64]*protocol.Packet) error {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		kind, seq, data, n, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("%s at offset %d: %w", seg.path, offset, err)
+			}
+			fmt.Printf("WAL: truncating torn record in %s at offset %d\n", seg.path, offset)
+			return os.Truncate(seg.path, offset)
+		}
+		offset += n
+
+		if seq >= l.nextSeq {
+			l.nextSeq = seq + 1
+		}
+		switch kind {
+		case kindMessage:
+			packet, err := protocol.NewDecoder(bytes.NewReader(data)).Decode()
+			if err != nil {
+				return fmt.Errorf("%s at offset %d: %w", seg.path, offset, err)
+			}
+			messages[seq] = packet
+			l.pending[seq] = seg
+			seg.outstanding++
+		case kindProcessed:
+			delete(messages, seq)
+			if owner, ok := l.pending[seq]; ok {
+				owner.outstanding--
+				delete(l.pending, seq)
+			}
+		}
+	}
+}
+
+// readRecord reads one record and returns its size on disk
+func readRecord(r io.Reader) (kind byte, seq uint64, data []byte, n int64, err error) {
+	var header [recordHeaderSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorrupt
+		}
+		return
+	}
+	kind = header[0]
+	seq = binary.BigEndian.Uint64(header[1:9])
+	length := binary.BigEndian.Uint32(header[9:13])
+	sum := binary.BigEndian.Uint32(header[13:17])
+	if length > protocol.MaxPayloadSize+protocol.MaxTopicSize+protocol.HeaderSize+1<<16 {
+		err = errCorrupt
+		return
+	}
+
+	data = make([]byte, length)
+	if _, err = io.ReadFull(r, data); err != nil {
+		err = errCorrupt
+		return
+	}
+	if checksum(header[:13], data) != sum {
+		err = errCorrupt
+		return
+	}
+	return kind, seq, data, int64(recordHeaderSize) + int64(length), nil
+}
+
+func checksum(header, data []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	crc.Write(data)
+	return crc.Sum32()
+}
+
+// Append logs a message and returns its sequence number. With SyncAlways
+// the record is on stable storage when Append returns.
+func (l *Log) Append(p *protocol.Packet) (uint64, error) {
+	data, err := protocol.Encode(p)
+	if err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+	seq := l.nextSeq
+	if err := l.write(kindMessage, seq, data); err != nil {
+		return 0, err
+	}
+	l.nextSeq++
+
+	seg := l.segments[len(l.segments)-1]
+	seg.outstanding++
+	l.pending[seq] = seg
+
+	if l.size >= l.options.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// MarkProcessed records that the message with sequence number seq was
+// handled, so recovery will not deliver it again. Segments whose messages
+// are all processed are deleted.
+func (l *Log) MarkProcessed(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	seg, ok := l.pending[seq]
+	if !ok {
+		return nil
+	}
+	if err := l.write(kindProcessed, seq, nil); err != nil {
+		return err
+	}
+	delete(l.pending, seq)
+	seg.outstanding--
+
+	l.trim()
+	return nil
+}
+
+// Pending returns the number of messages not yet marked processed
+func (l *Log) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.pending)
+}
+
+// LastSeq returns the sequence number of the newest message appended, or 0
+// if the log has none
+func (l *Log) LastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextSeq - 1
+}
+
+// Advance makes the messages appended from now on numbered above seq. A
+// broker calls it with sequence numbers it learned from another broker.
+func (l *Log) Advance(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq >= l.nextSeq {
+		l.nextSeq = seq + 1
+	}
+}
+
+// write appends one record to the current segment. The caller must hold mu.
+func (l *Log) write(kind byte, seq uint64, data []byte) error {
+	record := make([]byte, recordHeaderSize+len(data))
+	record[0] = kind
+	binary.BigEndian.PutUint64(record[1:9], seq)
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(data)))
+	copy(record[recordHeaderSize:], data)
+	binary.BigEndian.PutUint32(record[13:17], checksum(record[:13], data))
+
+	n, err := l.file.Write(record)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if l.options.Sync == SyncAlways {
+		return l.file.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// rotate closes the current segment and starts a new one at nextSeq.
+// The caller must hold mu.
+func (l *Log) rotate() error {
+	if l.file != nil {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+
+	seg := &segment{
+		base: l.nextSeq,
+		path: filepath.Join(l.options.Dir, fmt.Sprintf("%020d%s", l.nextSeq, segmentSuffix)),
+	}
+	file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+	l.dirty = false
+	l.segments = append(l.segments, seg)
+
+	l.trim()
+	return nil
+}
+
+// trim deletes the oldest segments once all their messages are processed.
+// Only a prefix of the log is removed, so processed records in later
+// segments always outlive the messages they refer to. The segment being
+// written is never removed. The caller must hold mu.
+func (l *Log) trim() {
+	for len(l.segments) > 1 && l.segments[0].outstanding == 0 {
+		if err := os.Remove(l.segments[0].path); err != nil && !os.IsNotExist(err) {
+			fmt.Println("WAL: error removing segment:", err)
+			return
+		}
+		l.segments = l.segments[1:]
+	}
+}
+
+// syncLoop flushes the log periodically for SyncInterval
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Sync(); err != nil && err != ErrClosed {
+				fmt.Println("WAL: error syncing:", err)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Sync flushes records written since the last flush to stable storage
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+// Close flushes and closes the log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	return err
+}